@@ -11,12 +11,58 @@ import (
 
 // コマンドライン引数の構造体。
 type Args struct {
-	InputFile  string `arg:"-i,--input-file"  help:"入力ファイルパス"                      placeholder:"SRC"`
-	OutputFile string `arg:"-o,--output-file" help:"出力ファイルパス（省略時は標準出力）"  placeholder:"DST"`
-	ToXML      bool   `arg:"-x,--to-xml"      help:"JSONからXMLへの変換モード"`
-	Minify     bool   `arg:"-m,--minify"      help:"整形出力を無効にする"`
-	Debug      bool   `arg:"-d,--debug"       help:"デバッグ出力を有効にする"`
-	ExportCode string `arg:"--code"           help:"バイナリに埋め込まれているソースコードを指定パスに出力する。"  placeholder:"DST"`
+	InputFile    string `arg:"-i,--input-file"  help:"入力ファイルパス"                      placeholder:"SRC"`
+	OutputFile   string `arg:"-o,--output-file" help:"出力ファイルパス（省略時は標準出力）"  placeholder:"DST"`
+	ToXML        bool   `arg:"-x,--to-xml"      help:"JSONからXMLへの変換モード"`
+	Minify       bool   `arg:"-m,--minify"      help:"整形出力を無効にする"`
+	Debug        bool   `arg:"-d,--debug"       help:"デバッグ出力を有効にする"`
+	Lenient      bool   `arg:"--lenient"        help:"JSONからXMLへの変換時に入力の構造検証を行わない"`
+	MultiRoots   string `arg:"--multiple-roots" help:"JSONのトップレベルに要素が複数ある場合の扱い (error, fragment, wrap)"  default:"error"  placeholder:"MODE"`
+	Wrapper      string `arg:"--wrapper"        help:"--multiple-roots wrap で使う包含要素の名前"  default:"root"  placeholder:"NAME"`
+	HTML         bool   `arg:"--html"           help:"入力をHTMLとして寛容に読み込む（空要素の自動終了、HTMLの文字実体参照、要素名の小文字化）"`
+	Entities     string `arg:"--entities"       help:"DOCTYPE で宣言された実体の参照の扱い (expand: 値に展開する, keep: 実体参照のノードとして残す)"  default:"expand"  placeholder:"MODE"`
+	Fragment     bool   `arg:"--fragment"       help:"XMLフラグメントとして扱い、トップレベルの要素ごとに1レコードとする"`
+	NDJSON       bool   `arg:"--ndjson"         help:"--fragment 指定時、JSONの配列ではなく1行1レコードのJSON Linesで出力する。--to-xml 指定時はJSON Linesを1行ずつ読み込む"`
+	C14N         string `arg:"--c14n"           help:"正規化したXMLを出力する (c14n, c14n-comments, exc-c14n, exc-c14n-comments)。--to-xml なしではXMLを読み込んで正規化する"  placeholder:"MODE"`
+	C14NPrefixes string `arg:"--c14n-prefixes" help:"--c14n exc-c14n 指定時、使われていなくても出力する名前空間の接頭辞（空白区切り、既定の名前空間は #default）"  placeholder:"PREFIXES"`
+	ExportCode   string `arg:"--code"           help:"バイナリに埋め込まれているソースコードを指定パスに出力する。"  placeholder:"DST"`
+
+	// JSONの出力
+	CanonicalJSON bool `arg:"--canonical-json" help:"RFC 8785 (JSON Canonicalization Scheme) の形式でJSONを出力する"`
+
+	// JSON表現の規約
+	Format        string `arg:"--format"         help:"XML以外の側の形式 (json, yaml, toml, msgpack, cbor, csv, idt, sql)"  default:"json"  placeholder:"FORMAT"`
+	Convention    string `arg:"--convention"     help:"JSON表現の規約 (default, xml2js, gdata, abdera)"  placeholder:"NAME"`
+	ExplicitArray bool   `arg:"--explicit-array" help:"xml2js: 子要素を常に配列にする（--explicit-array=false で無効）"  default:"true"`
+	MergeAttrs    bool   `arg:"--merge-attrs"    help:"xml2js: 属性を属性オブジェクトではなく要素のプロパティとして出力する"`
+	CharKey       string `arg:"--charkey"        help:"xml2js: テキストを格納するキー"  default:"_"  placeholder:"KEY"`
+	AttrKey       string `arg:"--attrkey"        help:"xml2js: 属性オブジェクトのキー"  default:"$"  placeholder:"KEY"`
+
+	// レコード分割
+	SplitAt      string `arg:"--split-at"      help:"指定したパス（/root/items/item の形式）の要素ごとに1行1レコードのJSON Linesで出力する"  placeholder:"PATH"`
+	SplitContext bool   `arg:"--split-context" help:"--split-at 指定時、各レコードを祖先の要素（属性のみ）で包んで出力する"`
+	Container    string `arg:"--container"     help:"--to-xml --ndjson 指定時、レコード全体を包む要素の名前"  placeholder:"NAME"`
+	Prolog       string `arg:"--prolog"        help:"--to-xml --ndjson 指定時、先頭に出力する $pi, $doctype, $comment を記述したJSONファイル"  placeholder:"FILE"`
+
+	// テーブル（table/col/row/td）
+	ValidateTables bool   `arg:"--validate-tables" help:"table 要素の各行を col の列定義（def, key 属性）に照らして検証する"`
+	TableRows      bool   `arg:"--table-rows"      help:"table 要素の各行を、col の列名をキーとするオブジェクトとして表現する"`
+	SQLDialect     string `arg:"--sql-dialect"     help:"--format sql で出力するSQLの方言 (sqlite, postgres)"  default:"sqlite"  placeholder:"DIALECT"`
+
+	// 予約キー
+	AttrPrefix   string `arg:"--attr-prefix"   help:"属性名の接頭辞"  default:"@"  placeholder:"PREFIX"`
+	TextKey      string `arg:"--text-key"      help:"テキスト内容のキー"  default:"$"  placeholder:"KEY"`
+	MetaPrefix   string `arg:"--meta-prefix"   help:"メタデータキー（$attrOrder, $comment など）の接頭辞"  default:"$"  placeholder:"PREFIX"`
+	EscapePrefix string `arg:"--escape-prefix" help:"予約キーと衝突する要素名に付ける接頭辞"  default:"~"  placeholder:"PREFIX"`
+
+	// サブコマンド
+	Query *QueryArgs `arg:"subcommand:query" help:"XPath 1.0 の式に一致するノードをJSONで出力する"`
+}
+
+// query サブコマンドの引数。
+type QueryArgs struct {
+	Expression string   `arg:"positional,required" help:"XPath 1.0 の式"  placeholder:"XPATH"`
+	Namespaces []string `arg:"-n,--ns"             help:"式で使う名前空間の接頭辞の割り当て（prefix=URI、複数指定可）"  placeholder:"PREFIX=URI"`
 }
 
 func (Args) Version() string {
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// JSON Lines のレコードからのXMLの組み立て
+// ---------------------------------------------------------------------
+
+// ConvertNDJSONToXML は1行1レコードのJSON Linesを読み込み、各レコードを順にXMLに変換して出力する。
+// 各行は --format の形式で読み込む。
+// --container を指定するとレコード全体をその要素で包み、--prolog で指定したJSONの $pi, $doctype, $comment を先頭に出力する。
+// XMLを書き出す前に全てのレコードを検証するため入力は2回読むが、いずれも1行ずつ処理し、レコード全体をメモリに保持しない。
+func ConvertNDJSONToXML(input io.Reader, output io.Writer) {
+	if args.Container != "" && !isValidXMLName(args.Container) {
+		panic(errors.Errorf("包含要素の名前として使えません: %q", args.Container))
+	}
+	prolog, err := readPrologJSON(args.Prolog)
+	if err != nil {
+		panic(err)
+	}
+
+	spool, err := newNDJSONSpool(input)
+	if err != nil {
+		panic(err)
+	}
+	defer spool.close()
+
+	// 1回目は検証のみ行い、不正なレコードがあれば何も書き出さずに終了する。
+	var buffer bytes.Buffer
+	forEachNDJSONRecord(spool.first, func(record map[string]interface{}) error {
+		buffer.Reset()
+		return writeXMLDocument(&buffer, record, true)
+	})
+
+	replay, err := spool.replay()
+	if err != nil {
+		panic(err)
+	}
+	writer := bufio.NewWriter(output)
+	defer func() {
+		if err := writer.Flush(); err != nil {
+			panic(errors.Errorf("XMLデータの書き込みに失敗しました: %v", err))
+		}
+	}()
+
+	// プロローグと包含要素の開始タグ。
+	buffer.Reset()
+	writeXMLProlog(&buffer, prolog, args.Container != "")
+	writeXMLChunk(writer, buffer.String(), "")
+	if args.Container != "" {
+		if _, err := io.WriteString(writer, "<"+args.Container+">\r\n"); err != nil {
+			panic(errors.Errorf("XMLデータの書き込みに失敗しました: %v", err))
+		}
+	}
+
+	indent := ""
+	if args.Container != "" {
+		indent = "\t"
+	}
+	forEachNDJSONRecord(replay, func(record map[string]interface{}) error {
+		buffer.Reset()
+		if err := writeXMLDocument(&buffer, record, true); err != nil {
+			return err
+		}
+		writeXMLChunk(writer, buffer.String(), indent)
+		return nil
+	})
+
+	if args.Container != "" {
+		if _, err := io.WriteString(writer, "</"+args.Container+">\r\n"); err != nil {
+			panic(errors.Errorf("XMLデータの書き込みに失敗しました: %v", err))
+		}
+	}
+}
+
+// forEachNDJSONRecord は入力の空でない行を --format の形式で読み込み、レコードごとに fn を呼ぶ。
+// 読み込みや fn のエラーは行番号を付けて panic する。
+func forEachNDJSONRecord(input io.Reader, fn func(record map[string]interface{}) error) {
+	reader := bufio.NewReader(input)
+	for lineNumber := 1; ; lineNumber++ {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			panic(errors.Errorf("入力の読み込みに失敗しました: %v", readErr))
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			record, err := unmarshalDocumentObject(trimmed)
+			if err != nil {
+				panic(errors.Errorf("%d行目: JSONのパースに失敗しました: %v", lineNumber, err))
+			}
+			if err := fn(record); err != nil {
+				panic(errors.Errorf("%d行目: %v", lineNumber, err))
+			}
+		}
+		if readErr == io.EOF {
+			return
+		}
+	}
+}
+
+// ndjsonSpool は入力を2回読めるようにする。
+// 通常のファイルは先頭に戻して読み直し、標準入力などは1回目の読み込み中に一時ファイルへ写す。
+type ndjsonSpool struct {
+	first  io.Reader     // 1回目に読む入力
+	seeker io.ReadSeeker // 2回目に読む入力
+	offset int64         // 2回目に読み始める位置
+	temp   *os.File      // 入力を写した一時ファイル（通常のファイルの場合は nil）
+}
+
+// newNDJSONSpool は入力を2回読むための ndjsonSpool を作成する。
+func newNDJSONSpool(input io.Reader) (*ndjsonSpool, error) {
+	if file, ok := input.(*os.File); ok {
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+			offset, err := file.Seek(0, io.SeekCurrent)
+			if err == nil {
+				return &ndjsonSpool{first: file, seeker: file, offset: offset}, nil
+			}
+		}
+	}
+	temp, err := os.CreateTemp("", "xml2json-*.ndjson")
+	if err != nil {
+		return nil, errors.Errorf("一時ファイルを作成できません: %v", err)
+	}
+	return &ndjsonSpool{first: io.TeeReader(input, temp), seeker: temp, temp: temp}, nil
+}
+
+// replay は2回目に読む入力を返す。
+func (s *ndjsonSpool) replay() (io.Reader, error) {
+	if _, err := s.seeker.Seek(s.offset, io.SeekStart); err != nil {
+		return nil, errors.Errorf("入力を読み直せません: %v", err)
+	}
+	return s.seeker, nil
+}
+
+// close は一時ファイルを削除する。
+func (s *ndjsonSpool) close() {
+	if s.temp != nil {
+		s.temp.Close()
+		os.Remove(s.temp.Name())
+	}
+}
+
+// readPrologJSON は --prolog で指定したJSONファイルを読み込む。
+// プロローグに置けるのは $pi, $doctype, $comment のみ。
+func readPrologJSON(path string) (map[string]interface{}, error) {
+	prolog := make(map[string]interface{})
+	if path == "" {
+		return prolog, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Errorf("プロローグのファイルを読み込めません: %v", err)
+	}
+	if err := json.Unmarshal(data, &prolog); err != nil {
+		return nil, errors.Errorf("プロローグのJSONのパースに失敗しました: %v", err)
+	}
+	for key := range prolog {
+		if key != keys.PI() && key != keys.Doctype() && key != keys.Comment() {
+			return nil, errors.Errorf("プロローグには %s, %s, %s 以外のキーは置けません: %q", keys.PI(), keys.Doctype(), keys.Comment(), key)
+		}
+	}
+	if !args.Lenient {
+		if violations := validateJSONDocument(prolog, false); len(violations) > 0 {
+			return nil, errors.Errorf("プロローグのJSONの構造が不正です（%d件）:\n%s", len(violations), strings.Join(violations, "\n"))
+		}
+	}
+	return prolog, nil
+}
+
+// writeXMLChunk はXMLの断片を整形して（--minify 指定時はそのまま）書き出す。
+func writeXMLChunk(writer io.Writer, chunk string, indent string) {
+	if chunk == "" {
+		return
+	}
+	if !args.Minify {
+		// 整形で生じる空白だけの行は取り除く。
+		var lines []string
+		for _, line := range strings.Split(formatXML(chunk, indent, "\t"), "\n") {
+			if strings.TrimSpace(line) != "" {
+				lines = append(lines, strings.TrimRight(line, "\r"))
+			}
+		}
+		chunk = strings.Join(lines, "\n") + "\n"
+	}
+	// 出力直前に改行コードをCRLFに統一する
+	if _, err := io.WriteString(writer, normalizeNewlinesToCRLF(chunk)); err != nil {
+		panic(errors.Errorf("XMLデータの書き込みに失敗しました: %v", err))
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// 正規化したXML（C14N 1.0, Exclusive XML Canonicalization）の出力
+// ---------------------------------------------------------------------
+
+// --c14n に指定できる値。
+const (
+	C14NInclusive             = "c14n"              // Canonical XML 1.0（コメントを除く）
+	C14NInclusiveWithComments = "c14n-comments"     // Canonical XML 1.0（コメントを含む）
+	C14NExclusive             = "exc-c14n"          // Exclusive XML Canonicalization 1.0（コメントを除く）
+	C14NExclusiveWithComments = "exc-c14n-comments" // Exclusive XML Canonicalization 1.0（コメントを含む）
+)
+
+// xml 接頭辞に結び付けられた名前空間。
+const xmlNamespaceURI = "http://www.w3.org/XML/1998/namespace"
+
+// currentC14NMode は --c14n の値を返す。未指定の場合は空文字列。
+func currentC14NMode() string {
+	return strings.ToLower(args.C14N)
+}
+
+// checkC14NMode は --c14n の指定と、同時に指定できないオプションを確認する。
+func checkC14NMode() error {
+	switch currentC14NMode() {
+	case "":
+		if args.C14NPrefixes != "" {
+			return errors.Errorf("--c14n-prefixes は --c14n exc-c14n と同時に指定してください")
+		}
+		return nil
+	case C14NInclusive, C14NInclusiveWithComments:
+		if args.C14NPrefixes != "" {
+			return errors.Errorf("--c14n-prefixes は Exclusive XML Canonicalization でのみ使えます")
+		}
+	case C14NExclusive, C14NExclusiveWithComments:
+	default:
+		return errors.Errorf("未対応の --c14n の値です: %v", args.C14N)
+	}
+	if args.HTML || args.NDJSON || args.SplitAt != "" {
+		return errors.Errorf("--c14n は --html, --ndjson, --split-at と同時に指定できません")
+	}
+	if isTableDirectoryFormat() || currentFormat() == FormatSQL {
+		return errors.Errorf("--c14n は --format %s と同時に指定できません", currentFormat())
+	}
+	return nil
+}
+
+// ConvertXMLToC14N は入力のXMLを正規化して出力する。
+func ConvertXMLToC14N(inputString []byte, output io.Writer) {
+	canonical, err := canonicalizeXML(inputString, currentC14NMode())
+	if err != nil {
+		panic(errors.Errorf("XMLの正規化に失敗しました: %v", err))
+	}
+	if _, err := output.Write(canonical); err != nil {
+		panic(errors.Errorf("XMLデータの書き込みに失敗しました: %v", err))
+	}
+}
+
+// c14nScope は要素ごとの名前空間の状態。
+type c14nScope struct {
+	inScope  map[string]string // 有効な名前空間宣言（接頭辞 "" は既定の名前空間）
+	rendered map[string]string // 出力済みの祖先で宣言した名前空間
+}
+
+// canonicalizeXML はXMLを正規化する。XML宣言と DOCTYPE は出力せず、空要素は開始タグと終了タグに展開し、
+// 名前空間宣言と属性を規定の順に並べ、文字参照と実体参照を展開して規定の文字だけをエスケープする。
+// 改行は LF とし、ルート要素の外の処理命令とコメントは改行で区切る。
+func canonicalizeXML(input []byte, mode string) ([]byte, error) {
+	withComments := mode == C14NInclusiveWithComments || mode == C14NExclusiveWithComments
+	exclusive := mode == C14NExclusive || mode == C14NExclusiveWithComments
+	inclusivePrefixes := strings.Fields(args.C14NPrefixes)
+
+	decoder := xml.NewDecoder(bytes.NewReader(input))
+	var out bytes.Buffer
+	scopes := []c14nScope{{inScope: map[string]string{}, rendered: map[string]string{}}}
+	afterRoot := false
+	var attlists map[string][]map[string]interface{} // 要素名ごとの ATTLIST の属性の定義
+	for {
+		start := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		depth := len(scopes) - 1
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			parent := scopes[len(scopes)-1]
+			scope := c14nScope{inScope: copyNSContext(parent.inScope), rendered: copyNSContext(parent.rendered)}
+			var attrs []xml.Attr
+			for _, attr := range t.Attr {
+				switch {
+				case attr.Name.Space == "xmlns":
+					scope.inScope[attr.Name.Local] = attr.Value
+				case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+					scope.inScope[""] = attr.Value
+				default:
+					attrs = append(attrs, attr)
+				}
+			}
+			// 属性値の改行やタブは、XMLプロセッサーと同様に空白に正規化する（文字参照で書かれたものを除く）。
+			if raw := input[start:decoder.InputOffset()]; len(raw) > 0 {
+				normalizeC14NAttrs(attrs, raw, decoder.Entity)
+			}
+			// DOCTYPE の ATTLIST で既定値が宣言された属性を補い、CDATA 以外の型の属性値の空白をまとめる。
+			attrs = applyC14NAttlist(t, attrs, scope, attlists[c14nName(t.Name)], decoder.Entity)
+
+			out.WriteString("<" + c14nName(t.Name))
+			for _, prefix := range c14nNamespacesToRender(t, attrs, scope, exclusive, inclusivePrefixes) {
+				uri := scope.inScope[prefix]
+				scope.rendered[prefix] = uri
+				if prefix == "" {
+					out.WriteString(` xmlns="` + escapeC14NAttr(uri) + `"`)
+				} else {
+					out.WriteString(" xmlns:" + prefix + `="` + escapeC14NAttr(uri) + `"`)
+				}
+			}
+			sort.SliceStable(attrs, func(i, j int) bool {
+				ui, uj := c14nAttrNamespace(attrs[i], scope), c14nAttrNamespace(attrs[j], scope)
+				if ui != uj {
+					return ui < uj
+				}
+				return attrs[i].Name.Local < attrs[j].Name.Local
+			})
+			for _, attr := range attrs {
+				out.WriteString(" " + c14nName(attr.Name) + `="` + escapeC14NAttr(attr.Value) + `"`)
+			}
+			out.WriteString(">")
+			scopes = append(scopes, scope)
+
+		case xml.EndElement:
+			out.WriteString("</" + c14nName(t.Name) + ">")
+			if len(scopes) > 1 {
+				scopes = scopes[:len(scopes)-1]
+			}
+			if len(scopes) == 1 {
+				afterRoot = true
+			}
+
+		case xml.CharData:
+			// ルート要素の外の空白は出力しない。
+			if depth > 0 {
+				out.WriteString(escapeC14NText(string(t)))
+			}
+
+		case xml.Comment:
+			if withComments {
+				writeC14NTopLevelSeparator(&out, depth, afterRoot, func() { out.WriteString("<!--" + string(t) + "-->") })
+			}
+
+		case xml.ProcInst:
+			if t.Target == "xml" {
+				continue
+			}
+			writeC14NTopLevelSeparator(&out, depth, afterRoot, func() {
+				out.WriteString("<?" + t.Target)
+				if len(t.Inst) > 0 {
+					out.WriteString(" " + string(t.Inst))
+				}
+				out.WriteString("?>")
+			})
+
+		case xml.Directive:
+			// DOCTYPE は出力しないが、宣言された実体は以降の参照の展開に使う。
+			if !isDoctypeDirective(t) {
+				return nil, errors.Errorf("DOCTYPE 以外の宣言には対応していません: <!%s>", string(t))
+			}
+			doctype, err := parseDoctype(string(rawDirective(t, input[start:decoder.InputOffset()])))
+			if err != nil {
+				return nil, errors.Errorf("DOCTYPE が不正です: %v", err)
+			}
+			entities, err := parseEntityDeclarations(doctype)
+			if err != nil {
+				return nil, errors.Errorf("DOCTYPE の実体宣言が不正です: %v", err)
+			}
+			decoder.Entity = entities
+			attlists = c14nAttlists(doctype)
+		}
+	}
+	if len(scopes) > 1 {
+		return nil, errors.Errorf("閉じられていない要素があります")
+	}
+	return out.Bytes(), nil
+}
+
+// writeC14NTopLevelSeparator はルート要素の外のノードを、ルート要素の前なら後ろに、後なら前に改行を付けて書き出す。
+func writeC14NTopLevelSeparator(out *bytes.Buffer, depth int, afterRoot bool, write func()) {
+	if depth == 0 && afterRoot {
+		out.WriteString("\n")
+	}
+	write()
+	if depth == 0 && !afterRoot {
+		out.WriteString("\n")
+	}
+}
+
+// c14nNamespacesToRender は要素に出力する名前空間宣言の接頭辞を、接頭辞の昇順（既定の名前空間が先頭）で返す。
+// C14N 1.0 では有効な全ての宣言を、Exclusive XML Canonicalization では要素名と属性名で使う接頭辞と
+// --c14n-prefixes で指定した接頭辞の宣言を対象とし、出力済みの祖先と同じ宣言は出力しない。
+func c14nNamespacesToRender(t xml.StartElement, attrs []xml.Attr, scope c14nScope, exclusive bool, inclusivePrefixes []string) []string {
+	candidates := make(map[string]bool)
+	if exclusive {
+		candidates[t.Name.Space] = true
+		for _, attr := range attrs {
+			if attr.Name.Space != "" {
+				candidates[attr.Name.Space] = true
+			}
+		}
+		for _, prefix := range inclusivePrefixes {
+			if prefix == "#default" {
+				prefix = ""
+			}
+			candidates[prefix] = true
+		}
+	} else {
+		for prefix := range scope.inScope {
+			candidates[prefix] = true
+		}
+		candidates[""] = true
+	}
+
+	var prefixes []string
+	for prefix := range candidates {
+		if prefix == "xml" {
+			continue
+		}
+		uri, declared := scope.inScope[prefix]
+		rendered, renderedBefore := scope.rendered[prefix]
+		if prefix == "" {
+			// 既定の名前空間は、出力済みの宣言（なければ空）と異なる場合のみ出力する。
+			if uri != rendered {
+				prefixes = append(prefixes, prefix)
+			}
+			continue
+		}
+		if declared && uri != "" && (!renderedBefore || rendered != uri) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// c14nAttrNamespace は属性の名前空間URIを返す。接頭辞のない属性は名前空間を持たない。
+func c14nAttrNamespace(attr xml.Attr, scope c14nScope) string {
+	switch attr.Name.Space {
+	case "":
+		return ""
+	case "xml":
+		return xmlNamespaceURI
+	}
+	return scope.inScope[attr.Name.Space]
+}
+
+// c14nName は接頭辞付きの名前を返す。
+func c14nName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// c14nAttlists は DOCTYPE の ATTLIST 宣言の属性の定義を要素名ごとにまとめる。
+func c14nAttlists(doctype map[string]interface{}) map[string][]map[string]interface{} {
+	attlists := make(map[string][]map[string]interface{})
+	subset, _ := doctype["subset"].([]interface{})
+	for _, item := range subset {
+		decl, ok := item.(map[string]interface{})
+		if !ok || decl["type"] != DoctypeDeclAttlist {
+			continue
+		}
+		name := doctypeField(decl, "name")
+		attributes, _ := decl["attributes"].([]interface{})
+		for _, attribute := range attributes {
+			if def, ok := attribute.(map[string]interface{}); ok {
+				attlists[name] = append(attlists[name], def)
+			}
+		}
+	}
+	return attlists
+}
+
+// applyC14NAttlist は開始タグにない属性のうち、既定値（#FIXED を含む）が宣言されたものを attrs に加える。
+// 既定値が宣言された名前空間宣言（xmlns, xmlns:p）は scope に加える。
+// また、型が CDATA 以外の属性は、値の前後の空白を取り除き、連続する空白を1つにまとめる。
+// 同じ属性が複数の ATTLIST で宣言されている場合は、XMLの規定どおり最初の宣言を使う。
+func applyC14NAttlist(t xml.StartElement, attrs []xml.Attr, scope c14nScope, defs []map[string]interface{}, entities map[string]string) []xml.Attr {
+	specified := make(map[string]bool)
+	for _, attr := range t.Attr {
+		specified[c14nName(attr.Name)] = true
+	}
+	types := make(map[string]string)
+	for _, def := range defs {
+		name := doctypeField(def, "name")
+		if _, ok := types[name]; ok {
+			continue
+		}
+		types[name] = doctypeField(def, "type")
+		value, ok := def["value"].(string)
+		if !ok || specified[name] {
+			continue
+		}
+		value = decodeC14NAttrValue(value, value, entities)
+		switch prefix, local, _ := strings.Cut(name, ":"); {
+		case name == "xmlns":
+			scope.inScope[""] = value
+		case prefix == "xmlns":
+			scope.inScope[local] = value
+		case local != "":
+			attrs = append(attrs, xml.Attr{Name: xml.Name{Space: prefix, Local: local}, Value: value})
+		default:
+			attrs = append(attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+		}
+	}
+	for i := range attrs {
+		if attrType, ok := types[c14nName(attrs[i].Name)]; ok && attrType != "CDATA" {
+			attrs[i].Value = strings.Join(strings.FieldsFunc(attrs[i].Value, func(r rune) bool { return r == ' ' }), " ")
+		}
+	}
+	return attrs
+}
+
+// normalizeC14NAttrs は開始タグの入力から属性値を読み直し、改行やタブを空白にしてから参照を展開した値に置き換える。
+// 属性の数が開始タグと一致しない場合はデコーダーの値のままとする。
+func normalizeC14NAttrs(attrs []xml.Attr, raw []byte, entities map[string]string) {
+	matches := reSourceAttr.FindAllSubmatch(raw, -1)
+	var values [][]byte
+	for _, m := range matches {
+		name := string(m[1])
+		if name == "xmlns" || strings.HasPrefix(name, "xmlns:") {
+			continue
+		}
+		if m[2] != nil {
+			values = append(values, m[2])
+		} else {
+			values = append(values, m[3])
+		}
+	}
+	if len(values) != len(attrs) {
+		return
+	}
+	for i := range attrs {
+		attrs[i].Value = decodeC14NAttrValue(string(values[i]), attrs[i].Value, entities)
+	}
+}
+
+// decodeC14NAttrValue は属性値の入力での書き方の改行やタブを空白にしてから、参照を展開した値を返す。
+// 読み込めない場合は def を返す。
+func decodeC14NAttrValue(raw string, def string, entities map[string]string) string {
+	normalized := strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ", "\t", " ").Replace(raw)
+	decoder := xml.NewDecoder(strings.NewReader(`<x a="` + strings.ReplaceAll(normalized, `"`, "&quot;") + `"/>`))
+	decoder.Entity = entities
+	if token, err := decoder.Token(); err == nil {
+		if start, ok := token.(xml.StartElement); ok && len(start.Attr) == 1 {
+			return start.Attr[0].Value
+		}
+	}
+	return def
+}
+
+// escapeC14NText はテキストの &, <, >, CR をエスケープする。
+func escapeC14NText(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;").Replace(s)
+}
+
+// escapeC14NAttr は属性値の &, <, ", タブ, LF, CR をエスケープする。
+func escapeC14NAttr(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;").Replace(s)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// 正規化したJSON（RFC 8785 JSON Canonicalization Scheme）の出力
+// ---------------------------------------------------------------------
+
+// JCS では空白を入れず、オブジェクトのキーを UTF-16 のコード単位の順に並べ、
+// 数値を ECMAScript の Number の文字列化と同じ形式で、文字列を最小限のエスケープで出力する。
+// 同じ内容からは常に同じバイト列になるため、変更検出のハッシュに使える。
+
+// checkCanonicalJSON は --canonical-json と同時に指定できないオプションを確認する。
+func checkCanonicalJSON() error {
+	if !args.CanonicalJSON {
+		return nil
+	}
+	if ToXML {
+		return errors.Errorf("--canonical-json はXMLからJSONへの変換でのみ使えます")
+	}
+	if currentFormat() != FormatJSON {
+		return errors.Errorf("--canonical-json は --format json でのみ使えます")
+	}
+	if args.C14N != "" {
+		return errors.Errorf("--canonical-json は --c14n と同時に指定できません")
+	}
+	return nil
+}
+
+// marshalJSONLine は JSON Lines の1行分の JSON を返す。--canonical-json 指定時は正規化した JSON とする。
+func marshalJSONLine(v interface{}) ([]byte, error) {
+	if args.CanonicalJSON {
+		return marshalCanonicalJSON(v)
+	}
+	return json.Marshal(v)
+}
+
+// marshalCanonicalJSON は値を JCS の形式の JSON にする。
+// 内部表現には []string や map[string][]string なども含まれるため、一度 encoding/json で JSON にしてから読み直し、
+// 汎用の値（map[string]interface{}, []interface{}, json.Number など）として書き出す。
+func marshalCanonicalJSON(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	if err := writeCanonicalJSON(&buffer, generic); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// writeCanonicalJSON は汎用の値を JCS の形式で書き出す。
+func writeCanonicalJSON(buffer *bytes.Buffer, v interface{}) error {
+	switch value := v.(type) {
+	case nil:
+		buffer.WriteString("null")
+	case bool:
+		buffer.WriteString(strconv.FormatBool(value))
+	case json.Number:
+		f, err := strconv.ParseFloat(string(value), 64)
+		if err != nil {
+			return errors.Errorf("数値を倍精度浮動小数点数として扱えません: %s", value)
+		}
+		s, err := canonicalJSONNumber(f)
+		if err != nil {
+			return err
+		}
+		buffer.WriteString(s)
+	case string:
+		writeCanonicalJSONString(buffer, value)
+	case []interface{}:
+		buffer.WriteString("[")
+		for i, item := range value {
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			if err := writeCanonicalJSON(buffer, item); err != nil {
+				return err
+			}
+		}
+		buffer.WriteString("]")
+	case map[string]interface{}:
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return lessUTF16(names[i], names[j])
+		})
+		buffer.WriteString("{")
+		for i, name := range names {
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			writeCanonicalJSONString(buffer, name)
+			buffer.WriteString(":")
+			if err := writeCanonicalJSON(buffer, value[name]); err != nil {
+				return err
+			}
+		}
+		buffer.WriteString("}")
+	default:
+		return errors.Errorf("JSONにできない値です: %T", v)
+	}
+	return nil
+}
+
+// canonicalJSONNumber は数値を ECMAScript の Number.prototype.toString と同じ形式にする。
+// 10^-6 以上 10^21 未満の絶対値は指数を使わずに、それ以外は 1e+21, 1e-7 のように最短の桁数で表す。
+func canonicalJSONNumber(f float64) (string, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", errors.Errorf("NaN と無限大は JSON にできません")
+	}
+	if f == 0 {
+		// -0 も 0 とする。
+		return "0", nil
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs < 1e-6 || abs >= 1e21 {
+		format = 'e'
+	}
+	s := strconv.FormatFloat(f, format, -1, 64)
+	if format == 'e' {
+		// Go の指数は2桁以上（1e-07）のため、先頭の0を取り除く。
+		n := len(s)
+		if n >= 4 && s[n-4] == 'e' && s[n-2] == '0' {
+			s = s[:n-2] + s[n-1:]
+		}
+	}
+	return s, nil
+}
+
+// writeCanonicalJSONString は文字列を引用符で囲み、", \ と制御文字だけをエスケープして書き出す。
+// <, >, & や U+2028, U+2029 はエスケープしない。
+func writeCanonicalJSONString(buffer *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+	buffer.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buffer.WriteString(`\"`)
+		case '\\':
+			buffer.WriteString(`\\`)
+		case '\b':
+			buffer.WriteString(`\b`)
+		case '\f':
+			buffer.WriteString(`\f`)
+		case '\n':
+			buffer.WriteString(`\n`)
+		case '\r':
+			buffer.WriteString(`\r`)
+		case '\t':
+			buffer.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				buffer.WriteString(`\u00`)
+				buffer.WriteByte(hex[r>>4])
+				buffer.WriteByte(hex[r&0xF])
+			} else {
+				buffer.WriteRune(r)
+			}
+		}
+	}
+	buffer.WriteByte('"')
+}
+
+// lessUTF16 は文字列を UTF-16 のコード単位の列として比較する。
+func lessUTF16(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
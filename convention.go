@@ -0,0 +1,716 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// JSON表現の規約（convention）の切り替え
+// ---------------------------------------------------------------------
+
+// 対応している規約名。
+const (
+	ConventionDefault = "default" // 本ツール独自の @/$ 形式
+	ConventionXML2JS  = "xml2js"  // Node.js の xml2js 互換形式
+	ConventionGData   = "gdata"   // Google の GData JSON 形式
+	ConventionAbdera  = "abdera"  // Apache Abdera の JSON 形式
+)
+
+// 現在の規約名を返す。未指定の場合は default とする。
+func currentConvention() string {
+	if args.Convention == "" {
+		return ConventionDefault
+	}
+	return strings.ToLower(args.Convention)
+}
+
+// 規約名が対応しているものかどうかを確認する。
+func checkConvention() error {
+	switch currentConvention() {
+	case ConventionDefault, ConventionXML2JS, ConventionGData, ConventionAbdera:
+	default:
+		return errors.Errorf("未対応の規約です: %v", args.Convention)
+	}
+	// 要素のプロパティにした属性は子要素と区別できず、XMLに戻すと子要素や xmlns:p のような不正な要素名になるため、
+	// JSONからXMLへの変換では受け付けない。
+	if ToXML && args.MergeAttrs {
+		return errors.Errorf("--merge-attrs はXMLからJSONへの変換でのみ使えます（属性と子要素を区別できないため、XMLに戻せません）")
+	}
+	return nil
+}
+
+// 既定の内部表現を指定の規約に変換する。
+func convertFromDefaultConvention(root map[string]interface{}) map[string]interface{} {
+	if args.TableRows {
+		if err := tableRowsToObjects(root); err != nil {
+			panic(err)
+		}
+	}
+	switch currentConvention() {
+	case ConventionXML2JS:
+		return defaultToXML2JS(root)
+	case ConventionGData:
+		return defaultToGData(root)
+	case ConventionAbdera:
+		return defaultToAbdera(root)
+	}
+	return root
+}
+
+// 指定の規約のJSONを既定の内部表現に変換する。
+func convertToDefaultConvention(root map[string]interface{}) map[string]interface{} {
+	switch currentConvention() {
+	case ConventionXML2JS:
+		return xml2jsToDefault(root)
+	case ConventionGData:
+		return gdataToDefault(root)
+	case ConventionAbdera:
+		return abderaToDefault(root)
+	}
+	return root
+}
+
+// ---------------------------------------------------------------------
+// xml2js 互換形式
+// ---------------------------------------------------------------------
+
+// xml2js の charkey。既定値は "_"。
+func xml2jsCharKey() string {
+	if args.CharKey == "" {
+		return "_"
+	}
+	return args.CharKey
+}
+
+// xml2js の attrkey。既定値は "$"。
+func xml2jsAttrKey() string {
+	if args.AttrKey == "" {
+		return "$"
+	}
+	return args.AttrKey
+}
+
+// defaultToXML2JS は既定の内部表現を xml2js の parseString 相当の形に変換する。
+// xml2js はコメント・処理命令・DOCTYPE を保持しないため、これらのメタデータは出力しない。
+func defaultToXML2JS(root map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for name, value := range root {
+		if !keys.IsElement(name) {
+			continue
+		}
+		// ルート要素は配列にしない（xml2js の explicitRoot 相当）。
+		if arr, ok := value.([]interface{}); ok && len(arr) > 0 {
+			value = arr[0]
+		}
+		element, _ := value.(map[string]interface{})
+		nsContext := make(map[string]string)
+		result[qualifiedElementName(name, element, nsContext)] = defaultElementToXML2JS(element, nsContext)
+	}
+	return result
+}
+
+// qualifiedElementName は要素名の名前空間URIを、要素自身と祖先の xmlns 宣言を使ってプレフィックスに戻す。
+// 要素自身の xmlns 宣言は nsContext に追加される。
+func qualifiedElementName(name string, element map[string]interface{}, nsContext map[string]string) string {
+	name = keys.UnescapeName(name)
+	switch ns := element[keys.Xmlns()].(type) {
+	case map[string]interface{}:
+		for prefix, uri := range ns {
+			nsContext[prefix] = fmt.Sprintf("%v", uri)
+		}
+	case string:
+		// 既定の名前空間宣言 xmlns="..." は文字列のまま格納されている。
+		nsContext[keys.Text] = ns
+	}
+	return resolvePrefixedName(name, nsContext)
+}
+
+// resolvePrefixedName は "URI:ローカル名" 形式の名前を、名前空間コンテキストを使って "プレフィックス:ローカル名" に戻す。
+// 既定の名前空間（プレフィックスがテキストキー）と一致する場合はローカル名のみを返す。
+func resolvePrefixedName(rawName string, nsContext map[string]string) string {
+	idx := strings.LastIndex(rawName, ":")
+	if idx == -1 {
+		return rawName
+	}
+	nsURI := rawName[:idx]
+	localName := rawName[idx+1:]
+	prefixes := make([]string, 0, len(nsContext))
+	for p := range nsContext {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	for _, p := range prefixes {
+		if nsContext[p] == nsURI {
+			if p == keys.Text {
+				return localName
+			}
+			return p + ":" + localName
+		}
+	}
+	return rawName
+}
+
+// qualifiedAttributes は要素の属性を "プレフィックス:ローカル名" をキーとするマップにして返す。
+// xmlns 宣言も "xmlns" / "xmlns:プレフィックス" という通常の属性として含める。
+func qualifiedAttributes(element map[string]interface{}, nsContext map[string]string) map[string]interface{} {
+	attrs := make(map[string]interface{})
+	for _, key := range attributeKeysInOrder(element) {
+		if key == keys.Xmlns() {
+			switch ns := element[key].(type) {
+			case map[string]interface{}:
+				for prefix, uri := range ns {
+					if prefix == keys.Text {
+						attrs["xmlns"] = uri
+					} else {
+						attrs["xmlns:"+prefix] = uri
+					}
+				}
+			case string:
+				attrs["xmlns"] = ns
+			}
+			continue
+		}
+		attrs[resolvePrefixedName(strings.TrimPrefix(key, keys.AttrPrefix), nsContext)] = element[key]
+	}
+	return attrs
+}
+
+// setQualifiedAttribute は "プレフィックス:ローカル名" 形式の属性を既定の内部表現の要素に設定する。
+// xmlns 宣言は "@xmlns" にまとめ、通常の属性の場合は true を返す。
+func setQualifiedAttribute(element map[string]interface{}, attrName string, attrValue string) bool {
+	if attrName == "xmlns" || strings.HasPrefix(attrName, "xmlns:") {
+		if _, ok := element[keys.Xmlns()].(map[string]interface{}); !ok {
+			element[keys.Xmlns()] = make(map[string]interface{})
+		}
+		namespaces := element[keys.Xmlns()].(map[string]interface{})
+		if attrName == "xmlns" {
+			namespaces[keys.Text] = attrValue
+		} else {
+			namespaces[strings.TrimPrefix(attrName, "xmlns:")] = attrValue
+		}
+		return false
+	}
+	element[keys.Attr(attrName)] = attrValue
+	return true
+}
+
+// 要素を xml2js 形式に変換する。
+func defaultElementToXML2JS(element map[string]interface{}, nsContext map[string]string) interface{} {
+	charKey := xml2jsCharKey()
+	attrKey := xml2jsAttrKey()
+
+	attrs := qualifiedAttributes(element, nsContext)
+
+	var childNames []string
+	for key := range element {
+		if keys.IsElement(key) {
+			childNames = append(childNames, key)
+		}
+	}
+	sort.Strings(childNames)
+
+	text, hasText := element[keys.Text]
+
+	// 属性も子要素もない要素は文字列になる（xml2js の emptyTag は ""）。
+	if len(attrs) == 0 && len(childNames) == 0 {
+		if hasText {
+			return fmt.Sprintf("%v", text)
+		}
+		return ""
+	}
+
+	result := make(map[string]interface{})
+	if len(attrs) > 0 {
+		if args.MergeAttrs {
+			for k, v := range attrs {
+				xml2jsAssignOrPush(result, k, v)
+			}
+		} else {
+			result[attrKey] = attrs
+		}
+	}
+	if hasText {
+		result[charKey] = fmt.Sprintf("%v", text)
+	}
+	for _, name := range childNames {
+		var items []interface{}
+		if arr, ok := element[name].([]interface{}); ok {
+			items = arr
+		} else {
+			items = []interface{}{element[name]}
+		}
+		for _, item := range items {
+			child, _ := item.(map[string]interface{})
+			childNS := copyNSContext(nsContext)
+			childName := qualifiedElementName(name, child, childNS)
+			xml2jsAssignOrPush(result, childName, defaultElementToXML2JS(child, childNS))
+		}
+	}
+	return result
+}
+
+// xml2js の assignOrPush 相当。explicitArray が有効なら常に配列に格納する。
+func xml2jsAssignOrPush(obj map[string]interface{}, key string, value interface{}) {
+	existing, exists := obj[key]
+	if !exists {
+		if args.ExplicitArray {
+			obj[key] = []interface{}{value}
+		} else {
+			obj[key] = value
+		}
+		return
+	}
+	if arr, ok := existing.([]interface{}); ok {
+		obj[key] = append(arr, value)
+	} else {
+		obj[key] = []interface{}{existing, value}
+	}
+}
+
+// 名前空間コンテキストの複製を作成する。
+func copyNSContext(nsContext map[string]string) map[string]string {
+	localNS := make(map[string]string, len(nsContext))
+	for k, v := range nsContext {
+		localNS[k] = v
+	}
+	return localNS
+}
+
+// 要素の属性キー（@付き）を $attrOrder の順に返す。$attrOrder にないものは昇順で後ろに付ける。
+func attributeKeysInOrder(element map[string]interface{}) []string {
+	var rawAttrKeys []string
+	for k := range element {
+		if keys.IsAttr(k) {
+			rawAttrKeys = append(rawAttrKeys, k)
+		}
+	}
+	sort.Strings(rawAttrKeys)
+
+	var orderSlice []string
+	switch order := element[keys.AttrOrder()].(type) {
+	case []interface{}:
+		for _, v := range order {
+			if s, ok := v.(string); ok {
+				orderSlice = append(orderSlice, s)
+			}
+		}
+	case []string:
+		orderSlice = order
+	}
+
+	var ordered []string
+	seen := make(map[string]bool)
+	for _, key := range orderSlice {
+		// xmlns 宣言は $attrOrder では "@xmlns:p" として記録されているので "@xmlns" にまとめる。
+		if strings.HasPrefix(key, keys.Xmlns()+":") {
+			key = keys.Xmlns()
+		}
+		if _, exists := element[key]; exists && !seen[key] {
+			ordered = append(ordered, key)
+			seen[key] = true
+		}
+	}
+	for _, key := range rawAttrKeys {
+		if !seen[key] {
+			ordered = append(ordered, key)
+			seen[key] = true
+		}
+	}
+	return ordered
+}
+
+// xml2jsToDefault は xml2js 形式のJSON（xml2js の Builder に渡す形）を既定の内部表現に変換する。
+// mergeAttrs で統合された属性は子要素と区別できないため、xml2js の Builder と同様に子要素として扱う。
+func xml2jsToDefault(root map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for name, value := range root {
+		if arr, ok := value.([]interface{}); ok && len(arr) > 0 {
+			value = arr[0]
+		}
+		result[keys.EscapeName(name)] = xml2jsElementToDefault(value)
+	}
+	return result
+}
+
+// xml2js 形式の要素値を既定の内部表現に変換する。
+func xml2jsElementToDefault(value interface{}) interface{} {
+	charKey := xml2jsCharKey()
+	attrKey := xml2jsAttrKey()
+
+	switch v := value.(type) {
+	case []interface{}:
+		items := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			items = append(items, xml2jsElementToDefault(item))
+		}
+		return items
+	case map[string]interface{}:
+		element := make(map[string]interface{})
+		for key, child := range v {
+			switch key {
+			case attrKey:
+				attrs, ok := child.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				var attrNames []string
+				for attrName := range attrs {
+					attrNames = append(attrNames, attrName)
+				}
+				sort.Strings(attrNames)
+				var attrOrder []string
+				for _, attrName := range attrNames {
+					if setQualifiedAttribute(element, attrName, fmt.Sprintf("%v", attrs[attrName])) {
+						attrOrder = append(attrOrder, keys.Attr(attrName))
+					}
+				}
+				if len(attrOrder) > 0 {
+					element[keys.AttrOrder()] = attrOrder
+				}
+			case charKey:
+				element[keys.Text] = fmt.Sprintf("%v", child)
+			default:
+				childValue := xml2jsElementToDefault(child)
+				// table/col/row は既定の形式では常に配列として扱う。
+				if _, ok := childValue.([]interface{}); !ok && alwaysArrayElements[key] {
+					childValue = []interface{}{childValue}
+				}
+				element[keys.EscapeName(key)] = childValue
+			}
+		}
+		return element
+	case nil:
+		return make(map[string]interface{})
+	default:
+		text := fmt.Sprintf("%v", v)
+		if text == "" {
+			return make(map[string]interface{})
+		}
+		return map[string]interface{}{keys.Text: text}
+	}
+}
+
+// ---------------------------------------------------------------------
+// GData 形式
+// ---------------------------------------------------------------------
+
+// GData 形式のテキストのキー。
+const gdataTextKey = "$t"
+
+// GData 形式では名前空間プレフィックスの ":" を "$" に置き換える。
+func gdataName(name string) string {
+	return strings.ReplaceAll(name, ":", "$")
+}
+
+// defaultToGData は既定の内部表現を GData の JSON 形式に変換する。
+// XML宣言の version と encoding はトップレベルのプロパティになる。コメント、処理命令、DOCTYPE は出力しない。
+func defaultToGData(root map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for _, name := range []string{"version", "encoding"} {
+		if value := xmlDeclarationValue(root, name); value != "" {
+			result[name] = value
+		}
+	}
+	for name, value := range root {
+		if !keys.IsElement(name) {
+			continue
+		}
+		if arr, ok := value.([]interface{}); ok && len(arr) > 0 {
+			value = arr[0]
+		}
+		element, _ := value.(map[string]interface{})
+		nsContext := make(map[string]string)
+		result[gdataName(qualifiedElementName(name, element, nsContext))] = defaultElementToGData(element, nsContext)
+	}
+	return result
+}
+
+// 要素を GData 形式に変換する。属性は接頭辞なしのプロパティ、テキストは $t になる。
+func defaultElementToGData(element map[string]interface{}, nsContext map[string]string) map[string]interface{} {
+	result := make(map[string]interface{})
+	for attrName, attrValue := range qualifiedAttributes(element, nsContext) {
+		result[gdataName(attrName)] = fmt.Sprintf("%v", attrValue)
+	}
+	if text, ok := element[keys.Text]; ok {
+		result[gdataTextKey] = fmt.Sprintf("%v", text)
+	}
+	for key, value := range element {
+		if !keys.IsElement(key) {
+			continue
+		}
+		var items []interface{}
+		if arr, ok := value.([]interface{}); ok {
+			items = arr
+		} else {
+			items = []interface{}{value}
+		}
+		for _, item := range items {
+			child, _ := item.(map[string]interface{})
+			childNS := copyNSContext(nsContext)
+			childName := gdataName(qualifiedElementName(key, child, childNS))
+			childValue := defaultElementToGData(child, childNS)
+			if existing, exists := result[childName]; exists {
+				if arr, ok := existing.([]interface{}); ok {
+					result[childName] = append(arr, childValue)
+				} else {
+					result[childName] = []interface{}{existing, childValue}
+				}
+			} else if _, isArray := value.([]interface{}); isArray {
+				result[childName] = []interface{}{childValue}
+			} else {
+				result[childName] = childValue
+			}
+		}
+	}
+	return result
+}
+
+// gdataToDefault は GData 形式のJSONを既定の内部表現に変換する。
+// 文字列などのスカラー値は属性、オブジェクトは子要素、オブジェクトの配列は繰り返し要素として扱う。
+func gdataToDefault(root map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	var declaration []string
+	for _, name := range []string{"version", "encoding"} {
+		if value, ok := root[name].(string); ok {
+			declaration = append(declaration, fmt.Sprintf("%s=\"%s\"", name, value))
+		}
+	}
+	if len(declaration) > 0 {
+		result[keys.PI()] = []interface{}{map[string]interface{}{
+			"target": "xml",
+			"data":   strings.Join(declaration, " "),
+		}}
+	}
+	for name, value := range root {
+		if name == "version" || name == "encoding" {
+			continue
+		}
+		if _, ok := value.(map[string]interface{}); !ok {
+			continue
+		}
+		result[keys.EscapeName(strings.ReplaceAll(name, "$", ":"))] = gdataElementToDefault(value)
+	}
+	return result
+}
+
+// GData 形式の要素値を既定の内部表現に変換する。
+func gdataElementToDefault(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		items := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			items = append(items, gdataElementToDefault(item))
+		}
+		return items
+	case map[string]interface{}:
+		element := make(map[string]interface{})
+		var attrNames []string
+		for key, child := range v {
+			if key == gdataTextKey {
+				element[keys.Text] = fmt.Sprintf("%v", child)
+				continue
+			}
+			name := strings.ReplaceAll(key, "$", ":")
+			switch child.(type) {
+			case map[string]interface{}, []interface{}:
+				childValue := gdataElementToDefault(child)
+				if _, ok := childValue.([]interface{}); !ok && alwaysArrayElements[name] {
+					childValue = []interface{}{childValue}
+				}
+				element[keys.EscapeName(name)] = childValue
+			default:
+				attrNames = append(attrNames, name)
+			}
+		}
+		sort.Strings(attrNames)
+		var attrOrder []string
+		for _, attrName := range attrNames {
+			if setQualifiedAttribute(element, attrName, fmt.Sprintf("%v", v[gdataName(attrName)])) {
+				attrOrder = append(attrOrder, keys.Attr(attrName))
+			}
+		}
+		if len(attrOrder) > 0 {
+			element[keys.AttrOrder()] = attrOrder
+		}
+		return element
+	case nil:
+		return make(map[string]interface{})
+	default:
+		return map[string]interface{}{keys.Text: fmt.Sprintf("%v", v)}
+	}
+}
+
+// xmlDeclarationValue は $pi に格納されたXML宣言から擬似属性（version, encoding など）の値を取り出す。
+func xmlDeclarationValue(root map[string]interface{}, name string) string {
+	var data string
+	switch pis := root[keys.PI()].(type) {
+	case []map[string]string:
+		for _, pi := range pis {
+			if pi["target"] == "xml" {
+				data = pi["data"]
+			}
+		}
+	case []interface{}:
+		for _, item := range pis {
+			if pi, ok := item.(map[string]interface{}); ok && pi["target"] == "xml" {
+				data, _ = pi["data"].(string)
+			}
+		}
+	}
+	re := regexp.MustCompile(name + `\s*=\s*["']([^"']*)["']`)
+	if m := re.FindStringSubmatch(data); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// ---------------------------------------------------------------------
+// Abdera 形式
+// ---------------------------------------------------------------------
+
+// defaultToAbdera は既定の内部表現を Apache Abdera の JSON 形式に変換する。
+// 各要素は name, attributes, children を持つオブジェクトになり、children にはテキストと子要素が並ぶ。
+// 子要素の並び順は $orderMap に記録された順序に従う。
+func defaultToAbdera(root map[string]interface{}) map[string]interface{} {
+	orderMap, _ := root[keys.OrderMap()].(map[string][]string)
+	for name, value := range root {
+		if !keys.IsElement(name) {
+			continue
+		}
+		if arr, ok := value.([]interface{}); ok && len(arr) > 0 {
+			value = arr[0]
+		}
+		element, _ := value.(map[string]interface{})
+		return defaultElementToAbdera(name, name, element, make(map[string]string), orderMap)
+	}
+	return make(map[string]interface{})
+}
+
+// 要素を Abdera 形式に変換する。path は $orderMap の検索に使う要素のパス。
+func defaultElementToAbdera(name string, path string, element map[string]interface{}, nsContext map[string]string, orderMap map[string][]string) map[string]interface{} {
+	result := map[string]interface{}{
+		"name": qualifiedElementName(name, element, nsContext),
+	}
+	attrs := qualifiedAttributes(element, nsContext)
+	if len(attrs) > 0 {
+		result["attributes"] = attrs
+	}
+
+	children := []interface{}{}
+	if text, ok := element[keys.Text]; ok {
+		children = append(children, fmt.Sprintf("%v", text))
+	}
+	for _, key := range orderedChildNames(element, orderMap[path]) {
+		var items []interface{}
+		if arr, ok := element[key].([]interface{}); ok {
+			items = arr
+		} else {
+			items = []interface{}{element[key]}
+		}
+		for _, item := range items {
+			child, _ := item.(map[string]interface{})
+			children = append(children, defaultElementToAbdera(key, path+"/"+key, child, copyNSContext(nsContext), orderMap))
+		}
+	}
+	if len(children) > 0 {
+		result["children"] = children
+	}
+	return result
+}
+
+// orderedChildNames は子要素名を order に記録された順に返す。order にないものは昇順で後ろに付ける。
+func orderedChildNames(element map[string]interface{}, order []string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, key := range order {
+		if _, exists := element[key]; exists && !seen[key] {
+			names = append(names, key)
+			seen[key] = true
+		}
+	}
+	var rest []string
+	for key := range element {
+		if keys.IsElement(key) && !seen[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	return append(names, rest...)
+}
+
+// abderaToDefault は Abdera 形式のJSONを既定の内部表現に変換する。
+func abderaToDefault(root map[string]interface{}) map[string]interface{} {
+	name, element := abderaElementToDefault(root)
+	if name == "" {
+		return make(map[string]interface{})
+	}
+	if alwaysArrayElements[name] {
+		return map[string]interface{}{name: []interface{}{element}}
+	}
+	return map[string]interface{}{name: element}
+}
+
+// Abdera 形式の要素を既定の内部表現に変換し、要素名とともに返す。
+// children 内の複数のテキストは連結して $ に格納する。
+func abderaElementToDefault(node map[string]interface{}) (string, map[string]interface{}) {
+	name, _ := node["name"].(string)
+	if name != "" {
+		name = keys.EscapeName(name)
+	}
+	element := make(map[string]interface{})
+
+	if attrs, ok := node["attributes"].(map[string]interface{}); ok {
+		var attrNames []string
+		for attrName := range attrs {
+			attrNames = append(attrNames, attrName)
+		}
+		sort.Strings(attrNames)
+		var attrOrder []string
+		for _, attrName := range attrNames {
+			if setQualifiedAttribute(element, attrName, fmt.Sprintf("%v", attrs[attrName])) {
+				attrOrder = append(attrOrder, keys.Attr(attrName))
+			}
+		}
+		if len(attrOrder) > 0 {
+			element[keys.AttrOrder()] = attrOrder
+		}
+	}
+
+	var text strings.Builder
+	hasText := false
+	if children, ok := node["children"].([]interface{}); ok {
+		for _, child := range children {
+			switch c := child.(type) {
+			case map[string]interface{}:
+				childName, childElement := abderaElementToDefault(c)
+				if childName == "" {
+					continue
+				}
+				if existing, exists := element[childName]; exists {
+					if arr, ok := existing.([]interface{}); ok {
+						element[childName] = append(arr, childElement)
+					} else {
+						element[childName] = []interface{}{existing, childElement}
+					}
+				} else if alwaysArrayElements[childName] {
+					element[childName] = []interface{}{childElement}
+				} else {
+					element[childName] = childElement
+				}
+			case nil:
+			default:
+				text.WriteString(fmt.Sprintf("%v", c))
+				hasText = true
+			}
+		}
+	}
+	if hasText {
+		element[keys.Text] = text.String()
+	}
+	return name, element
+}
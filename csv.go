@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// table/col/row/td 形式の文書とCSVの相互変換
+// ---------------------------------------------------------------------
+
+// CSV, IDT 形式で出力するディレクトリに、テーブル以外の部分を保存するファイルの名前。
+// テーブルのファイルは必ず .csv または .idt で終わるため、テーブル名と衝突しない。
+const tableDocumentFileName = "document.json"
+
+// UTF-8 の BOM。表計算ソフトで文字化けしないよう、CSVの先頭に付ける。
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// ConvertXMLToCSV は table 要素ごとに「テーブル名.csv」を outputDir に書き出す。
+// 1行目は col の内容を見出しとし、2行目以降は row ごとの td の内容とする。
+// テーブルの行を除いた文書全体は document.json に保存し、ConvertCSVToXML で元のXMLに戻せるようにする。
+func ConvertXMLToCSV(inputString []byte, outputDir string) {
+	if outputDir == "" {
+		panic(errors.Errorf("--format csv では出力先のディレクトリを -o で指定してください"))
+	}
+	root := parseXMLToMap(inputString)
+	if err := checkTableDocument(root); err != nil {
+		panic(err)
+	}
+
+	tables := make(map[string][][]string)
+	var tableNames []string
+	err := walkTables(root, func(table map[string]interface{}) error {
+		name, err := tableFileName(table)
+		if err != nil {
+			return err
+		}
+		if _, exists := tables[name]; exists {
+			return errors.Errorf("テーブル %q が複数あります", name)
+		}
+		records, err := tableToCSVRecords(name, table)
+		if err != nil {
+			return err
+		}
+		tables[name] = records
+		tableNames = append(tableNames, name)
+		// 行はCSVに書き出すため、document.json には含めない。
+		delete(table, "row")
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if len(tableNames) == 0 {
+		panic(errors.Errorf("table 要素がありません"))
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		panic(errors.Errorf("出力ディレクトリを作成できません: %v", err))
+	}
+	for _, name := range tableNames {
+		if err := writeCSVFile(filepath.Join(outputDir, name+".csv"), tables[name]); err != nil {
+			panic(errors.Errorf("テーブル %q のCSVの書き込みに失敗しました: %v", name, err))
+		}
+	}
+
+	writeTableDocumentJSON(outputDir, root)
+}
+
+// ConvertCSVToXML は ConvertXMLToCSV が書き出したディレクトリから、元のXMLを組み立てる。
+// document.json のテーブルに、同じ名前のCSVファイルの2行目以降を row として戻す。
+func ConvertCSVToXML(inputDir string, output io.Writer) {
+	if inputDir == "" {
+		panic(errors.Errorf("--format csv では入力元のディレクトリを -i で指定してください"))
+	}
+	root, err := readTableDocumentJSON(inputDir)
+	if err != nil {
+		panic(err)
+	}
+	if root == nil {
+		panic(errors.Errorf("%s がありません", tableDocumentFileName))
+	}
+
+	found := make(map[string]bool)
+	err = walkTables(root, func(table map[string]interface{}) error {
+		name, err := tableFileName(table)
+		if err != nil {
+			return err
+		}
+		records, err := readCSVFile(filepath.Join(inputDir, name+".csv"))
+		if err != nil {
+			return errors.Errorf("テーブル %q のCSVを読み込めません: %v", name, err)
+		}
+		if err := csvRecordsToTable(name, table, records); err != nil {
+			return err
+		}
+		found[name] = true
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// document.json にないテーブルのCSVは、どこに置くべきか分からないためエラーとする。
+	csvFiles, _ := filepath.Glob(filepath.Join(inputDir, "*.csv"))
+	for _, file := range csvFiles {
+		if name := strings.TrimSuffix(filepath.Base(file), ".csv"); !found[name] {
+			panic(errors.Errorf("%s に対応するテーブルが %s にありません", filepath.Base(file), tableDocumentFileName))
+		}
+	}
+
+	writeTableDocumentXML(output, root)
+}
+
+// writeTableDocumentXML はテーブルの行を戻した文書をXMLとして output に書き出す。
+func writeTableDocumentXML(output io.Writer, root map[string]interface{}) {
+	var buffer bytes.Buffer
+	if err := writeXMLDocument(&buffer, root, false); err != nil {
+		panic(err)
+	}
+	result := buffer.Bytes()
+	if !args.Minify {
+		result = []byte(strings.TrimLeft(formatXML(string(result), "", "\t"), "\r\n"))
+	}
+	if _, err := output.Write([]byte(normalizeNewlinesToCRLF(string(result)))); err != nil {
+		panic(errors.Errorf("XMLデータの書き込みに失敗しました: %v", err))
+	}
+}
+
+// writeTableDocumentJSON はテーブルの行を除いた文書を document.json として outputDir に書き出す。
+func writeTableDocumentJSON(outputDir string, root map[string]interface{}) {
+	jsonData, err := json.MarshalIndent(root, "", "\t")
+	if err != nil {
+		panic(errors.Errorf("JSONへの変換に失敗しました: %v", err))
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, tableDocumentFileName), []byte(normalizeNewlinesToCRLF(string(jsonData))), 0644); err != nil {
+		panic(errors.Errorf("%s の書き込みに失敗しました: %v", tableDocumentFileName, err))
+	}
+}
+
+// readTableDocumentJSON は inputDir の document.json を読み込む。ファイルがない場合は nil を返す。
+func readTableDocumentJSON(inputDir string) (map[string]interface{}, error) {
+	documentData, err := os.ReadFile(filepath.Join(inputDir, tableDocumentFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Errorf("%s を読み込めません: %v", tableDocumentFileName, err)
+	}
+	var root map[string]interface{}
+	if err := json.Unmarshal(documentData, &root); err != nil {
+		return nil, errors.Errorf("%s のパースに失敗しました: %v", tableDocumentFileName, err)
+	}
+	return root, nil
+}
+
+// walkTables は文書中の table 要素を出現順に探し、fn を呼び出す。
+func walkTables(value interface{}, fn func(table map[string]interface{}) error) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(v) {
+			if !keys.IsElement(key) {
+				continue
+			}
+			if key == "table" {
+				for _, item := range asElementArray(v[key]) {
+					if table, ok := item.(map[string]interface{}); ok {
+						if err := fn(table); err != nil {
+							return err
+						}
+					}
+				}
+				continue
+			}
+			if err := walkTables(v[key], fn); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := walkTables(item, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 要素の値を配列として返す。
+func asElementArray(value interface{}) []interface{} {
+	if value == nil {
+		return nil
+	}
+	if arr, ok := value.([]interface{}); ok {
+		return arr
+	}
+	return []interface{}{value}
+}
+
+// tableFileName は table 要素の name 属性を返す。ファイル名として使えない名前はエラーとする。
+func tableFileName(table map[string]interface{}) (string, error) {
+	name, ok := table[keys.Attr("name")].(string)
+	if !ok || name == "" {
+		return "", errors.Errorf("name 属性のない table 要素があります")
+	}
+	if strings.ContainsAny(name, `/\:*?"<>|`) || name == "." || name == ".." {
+		return "", errors.Errorf("テーブル名 %q はファイル名として使えません", name)
+	}
+	return name, nil
+}
+
+// 要素のテキスト内容を返す。
+func elementText(value interface{}) string {
+	if m, ok := value.(map[string]interface{}); ok {
+		if text, ok := m[keys.Text]; ok {
+			return fmt.Sprintf("%v", text)
+		}
+		return ""
+	}
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// tableColumnNames は col の内容（列名）の並びを返す。
+func tableColumnNames(table map[string]interface{}) []string {
+	var columns []string
+	if cols, ok := table["col"]; ok {
+		for _, col := range asElementArray(cols) {
+			columns = append(columns, elementText(col))
+		}
+	}
+	return columns
+}
+
+// tableToCSVRecords は table 要素を見出し行付きのCSVのレコードに変換する。
+func tableToCSVRecords(name string, table map[string]interface{}) ([][]string, error) {
+	records := [][]string{tableColumnNames(table)}
+	rows, ok := table["row"]
+	if !ok {
+		return records, nil
+	}
+	for i, row := range asElementArray(rows) {
+		rowMap, _ := row.(map[string]interface{})
+		var record []string
+		for j, td := range asElementArray(rowMap["td"]) {
+			if tdMap, ok := td.(map[string]interface{}); ok {
+				for key := range tdMap {
+					// 入力での書き方の記録（$source など）は値に影響しないため無視する。
+					if key != keys.Text && !isSourceMeta(key) {
+						return nil, errors.Errorf("テーブル %q の %d行目 %d列目: 属性や子要素を持つ td はCSVで表現できません（%s）", name, i+1, j+1, key)
+					}
+				}
+			}
+			record = append(record, elementText(td))
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// csvRecordsToTable はCSVのレコードを table 要素の row として設定する。
+// 見出し行は col の内容と一致している必要がある。
+func csvRecordsToTable(name string, table map[string]interface{}, records [][]string) error {
+	if len(records) == 0 {
+		return errors.Errorf("テーブル %q のCSVに見出し行がありません", name)
+	}
+	columns := tableColumnNames(table)
+	if strings.Join(records[0], "\x00") != strings.Join(columns, "\x00") {
+		return errors.Errorf("テーブル %q のCSVの見出し行 %q が列の定義 %q と一致しません", name, records[0], columns)
+	}
+
+	rows := make([]interface{}, 0, len(records)-1)
+	for _, record := range records[1:] {
+		tds := make([]interface{}, 0, len(record))
+		for _, value := range record {
+			td := make(map[string]interface{})
+			if value != "" {
+				td[keys.Text] = value
+			}
+			tds = append(tds, td)
+		}
+		rows = append(rows, map[string]interface{}{"td": tds})
+	}
+	if len(rows) > 0 {
+		table["row"] = rows
+	}
+	return nil
+}
+
+// writeCSVFile はレコードをBOM付きUTF-8、CRLF改行のCSVファイルに書き出す。
+// 1列だけの空の値のレコードは、読み込み時に空行として読み飛ばされないよう "" と書き出す。
+func writeCSVFile(path string, records [][]string) error {
+	var buffer bytes.Buffer
+	buffer.Write(utf8BOM)
+	writer := csv.NewWriter(&buffer)
+	writer.UseCRLF = true
+	for _, record := range records {
+		if len(record) == 1 && record[0] == "" {
+			writer.Flush()
+			buffer.WriteString("\"\"\r\n")
+			continue
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buffer.Bytes(), 0644)
+}
+
+// readCSVFile はCSVファイルを読み込む。先頭のBOMは取り除き、行ごとの列数の違いは許容する。
+func readCSVFile(path string) ([][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, utf8BOM)))
+	reader.FieldsPerRecord = -1
+	return reader.ReadAll()
+}
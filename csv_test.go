@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// 1列のテーブルで値が空の行も、CSVを経由して失われないことを確認する。
+func TestCSVRoundTripKeepsEmptySingleColumnRows(t *testing.T) {
+	table := map[string]interface{}{
+		keys.Attr("name"): "Single",
+		"col":             []interface{}{map[string]interface{}{keys.Text: "Value"}},
+		"row": []interface{}{
+			map[string]interface{}{"td": []interface{}{map[string]interface{}{}}},
+			map[string]interface{}{"td": []interface{}{map[string]interface{}{keys.Text: "a"}}},
+		},
+	}
+	records, err := tableToCSVRecords("Single", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "Single.csv")
+	if err := writeCSVFile(path, records); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readCSVFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := map[string]interface{}{"col": table["col"]}
+	if err := csvRecordsToTable("Single", restored, read); err != nil {
+		t.Fatal(err)
+	}
+	rows := asElementArray(restored["row"])
+	if len(rows) != 2 {
+		t.Fatalf("行数 = %d, want 2", len(rows))
+	}
+	if got := elementText(asElementArray(rows[0].(map[string]interface{})["td"])[0]); got != "" {
+		t.Errorf("1行目 = %q, want \"\"", got)
+	}
+	if got := elementText(asElementArray(rows[1].(map[string]interface{})["td"])[0]); got != "a" {
+		t.Errorf("2行目 = %q, want \"a\"", got)
+	}
+}
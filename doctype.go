@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// DOCTYPE の構造化した表現（$doctype）
+// ---------------------------------------------------------------------
+
+// $doctype は次の形のオブジェクトで表す。以前の形式の文字列（"<!DOCTYPE ...>"）もそのまま出力できる。
+//
+//	{
+//		"name": "doc",
+//		"publicId": "-//Example//DTD Doc//EN",
+//		"systemId": "doc.dtd",
+//		"subset": [
+//			{"type": "element", "name": "doc", "content": "(p|q)*"},
+//			{"type": "attlist", "name": "doc", "attributes": [{"name": "id", "type": "ID", "default": "#REQUIRED"}]},
+//			{"type": "entity", "name": "product", "value": "Foo"},
+//			{"type": "entity", "name": "logo", "systemId": "logo.png", "notation": "png"},
+//			{"type": "notation", "name": "png", "publicId": "image/png"},
+//			{"type": "comment", "text": " ... "},
+//			{"type": "pi", "target": "app", "data": "..."},
+//			{"type": "peref", "name": "common"}
+//		]
+//	}
+//
+// パラメーター実体の宣言は "parameter": true を持つ。属性の既定値は "default"（#REQUIRED, #IMPLIED, #FIXED）と "value" で表す。
+
+// 内部サブセットの宣言の種類。
+const (
+	DoctypeDeclElement  = "element"
+	DoctypeDeclAttlist  = "attlist"
+	DoctypeDeclEntity   = "entity"
+	DoctypeDeclNotation = "notation"
+	DoctypeDeclComment  = "comment"
+	DoctypeDeclPI       = "pi"
+	DoctypeDeclPERef    = "peref"
+)
+
+// doctypeScanner は DOCTYPE の宣言を先頭から読み進める。
+type doctypeScanner struct {
+	s   string
+	pos int
+}
+
+func (d *doctypeScanner) eof() bool { return d.pos >= len(d.s) }
+
+func (d *doctypeScanner) skipSpace() {
+	for !d.eof() && strings.ContainsRune(" \t\r\n", rune(d.s[d.pos])) {
+		d.pos++
+	}
+}
+
+// consume は次が prefix であれば読み進めて true を返す。
+func (d *doctypeScanner) consume(prefix string) bool {
+	if strings.HasPrefix(d.s[d.pos:], prefix) {
+		d.pos += len(prefix)
+		return true
+	}
+	return false
+}
+
+// readToken は空白、引用符、括弧、> まで（括弧で始まる場合は対応する閉じ括弧と続く *?+ まで）を読む。
+func (d *doctypeScanner) readToken() string {
+	start := d.pos
+	if !d.eof() && d.s[d.pos] == '(' {
+		depth := 0
+		for !d.eof() {
+			c := d.s[d.pos]
+			d.pos++
+			if c == '(' {
+				depth++
+			} else if c == ')' {
+				depth--
+				if depth == 0 {
+					break
+				}
+			}
+		}
+		for !d.eof() && strings.ContainsRune("*?+", rune(d.s[d.pos])) {
+			d.pos++
+		}
+		return d.s[start:d.pos]
+	}
+	for !d.eof() && !strings.ContainsRune(" \t\r\n\"'()>[]", rune(d.s[d.pos])) {
+		d.pos++
+	}
+	return d.s[start:d.pos]
+}
+
+// readQuoted は引用符で囲まれた文字列を読み、引用符を除いた内容を返す。
+func (d *doctypeScanner) readQuoted() (string, error) {
+	if d.eof() || (d.s[d.pos] != '"' && d.s[d.pos] != '\'') {
+		return "", errors.Errorf("%d文字目: 引用符で囲まれた値が必要です", d.pos+1)
+	}
+	quote := d.s[d.pos]
+	end := strings.IndexByte(d.s[d.pos+1:], quote)
+	if end < 0 {
+		return "", errors.Errorf("%d文字目: 引用符が閉じられていません", d.pos+1)
+	}
+	value := d.s[d.pos+1 : d.pos+1+end]
+	d.pos += end + 2
+	return value, nil
+}
+
+// readUntil は end までを読み、end を除いた内容を返す。
+func (d *doctypeScanner) readUntil(end string) (string, error) {
+	i := strings.Index(d.s[d.pos:], end)
+	if i < 0 {
+		return "", errors.Errorf("%d文字目: %q が見つかりません", d.pos+1, end)
+	}
+	value := d.s[d.pos : d.pos+i]
+	d.pos += i + len(end)
+	return value, nil
+}
+
+// readExternalID は SYSTEM "sys" または PUBLIC "pub" "sys" を読み、decl に設定する。
+// 記法の宣言では PUBLIC のシステム識別子を省略できるため、requireSystem が false の場合は省略を許す。
+func (d *doctypeScanner) readExternalID(decl map[string]interface{}, requireSystem bool) (bool, error) {
+	d.skipSpace()
+	switch {
+	case d.consume("SYSTEM"):
+		d.skipSpace()
+		systemID, err := d.readQuoted()
+		if err != nil {
+			return false, err
+		}
+		decl["systemId"] = systemID
+	case d.consume("PUBLIC"):
+		d.skipSpace()
+		publicID, err := d.readQuoted()
+		if err != nil {
+			return false, err
+		}
+		decl["publicId"] = publicID
+		d.skipSpace()
+		if !d.eof() && (d.s[d.pos] == '"' || d.s[d.pos] == '\'') {
+			systemID, err := d.readQuoted()
+			if err != nil {
+				return false, err
+			}
+			decl["systemId"] = systemID
+		} else if requireSystem {
+			return false, errors.Errorf("%d文字目: PUBLIC にはシステム識別子が必要です", d.pos+1)
+		}
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// expectDeclEnd は宣言の終わりの > を読む。
+func (d *doctypeScanner) expectDeclEnd(kind string) error {
+	d.skipSpace()
+	if !d.consume(">") {
+		return errors.Errorf("%d文字目: %s の宣言が > で終わっていません", d.pos+1, kind)
+	}
+	return nil
+}
+
+// isDoctypeDirective は宣言が DOCTYPE かどうかを返す。HTMLの <!doctype html> のため大文字と小文字を区別しない。
+func isDoctypeDirective(directive []byte) bool {
+	s := strings.TrimSpace(string(directive))
+	return len(s) >= len("DOCTYPE") && strings.EqualFold(s[:len("DOCTYPE")], "DOCTYPE")
+}
+
+// rawDirective は宣言の入力での書き方 raw（"<!DOCTYPE ...>"）から xml.Directive を作り直す。
+// encoding/xml は宣言の中のコメントを取り除くため、内部サブセットのコメントを残すには入力から読み直す必要がある。
+// raw が宣言の形でない場合（--html 指定時など）は directive をそのまま返す。
+func rawDirective(directive xml.Directive, raw []byte) xml.Directive {
+	if len(raw) < len("<!>") || !bytes.HasPrefix(raw, []byte("<!")) || !bytes.HasSuffix(raw, []byte(">")) {
+		return directive
+	}
+	return xml.Directive(normalizeSourceNewlines(string(raw[2 : len(raw)-1])))
+}
+
+// parseDoctype は xml.Directive の内容（"DOCTYPE doc [...]"）を $doctype のオブジェクトにする。
+func parseDoctype(directive string) (map[string]interface{}, error) {
+	d := &doctypeScanner{s: directive}
+	d.skipSpace()
+	if !strings.EqualFold(d.readToken(), "DOCTYPE") {
+		return nil, errors.Errorf("DOCTYPE の宣言ではありません")
+	}
+	d.skipSpace()
+	doctype := map[string]interface{}{"name": d.readToken()}
+	if doctype["name"] == "" {
+		return nil, errors.Errorf("DOCTYPE にルート要素の名前がありません")
+	}
+	if _, err := d.readExternalID(doctype, true); err != nil {
+		return nil, err
+	}
+	d.skipSpace()
+	if d.consume("[") {
+		subset, err := d.parseSubset()
+		if err != nil {
+			return nil, err
+		}
+		doctype["subset"] = subset
+	}
+	d.skipSpace()
+	if !d.eof() {
+		return nil, errors.Errorf("%d文字目: DOCTYPE の末尾に解釈できない内容があります", d.pos+1)
+	}
+	return doctype, nil
+}
+
+// parseSubset は内部サブセットを ] まで読み、宣言の配列を返す。
+func (d *doctypeScanner) parseSubset() ([]interface{}, error) {
+	subset := []interface{}{}
+	for {
+		d.skipSpace()
+		if d.eof() {
+			return nil, errors.Errorf("内部サブセットが ] で閉じられていません")
+		}
+		if d.consume("]") {
+			return subset, nil
+		}
+		decl, err := d.parseDecl()
+		if err != nil {
+			return nil, err
+		}
+		subset = append(subset, decl)
+	}
+}
+
+// parseDecl は内部サブセットの宣言を1つ読む。
+func (d *doctypeScanner) parseDecl() (map[string]interface{}, error) {
+	switch {
+	case d.consume("<!--"):
+		text, err := d.readUntil("-->")
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": DoctypeDeclComment, "text": text}, nil
+	case d.consume("<?"):
+		target := d.readToken()
+		d.skipSpace()
+		data, err := d.readUntil("?>")
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": DoctypeDeclPI, "target": target, "data": data}, nil
+	case d.consume("%"):
+		name, err := d.readUntil(";")
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": DoctypeDeclPERef, "name": name}, nil
+	case d.consume("<!ELEMENT"):
+		d.skipSpace()
+		decl := map[string]interface{}{"type": DoctypeDeclElement, "name": d.readToken()}
+		d.skipSpace()
+		decl["content"] = d.readToken()
+		return decl, d.expectDeclEnd("ELEMENT")
+	case d.consume("<!ATTLIST"):
+		return d.parseAttlist()
+	case d.consume("<!ENTITY"):
+		return d.parseEntity()
+	case d.consume("<!NOTATION"):
+		d.skipSpace()
+		decl := map[string]interface{}{"type": DoctypeDeclNotation, "name": d.readToken()}
+		ok, err := d.readExternalID(decl, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.Errorf("%d文字目: NOTATION には SYSTEM または PUBLIC が必要です", d.pos+1)
+		}
+		return decl, d.expectDeclEnd("NOTATION")
+	}
+	return nil, errors.Errorf("%d文字目: 内部サブセットの解釈できない宣言です", d.pos+1)
+}
+
+// parseAttlist は ATTLIST 宣言の要素名以降を読む。
+func (d *doctypeScanner) parseAttlist() (map[string]interface{}, error) {
+	d.skipSpace()
+	decl := map[string]interface{}{"type": DoctypeDeclAttlist, "name": d.readToken()}
+	attributes := []interface{}{}
+	for {
+		d.skipSpace()
+		if d.consume(">") {
+			decl["attributes"] = attributes
+			return decl, nil
+		}
+		if d.eof() {
+			return nil, errors.Errorf("ATTLIST の宣言が > で終わっていません")
+		}
+		attr := map[string]interface{}{"name": d.readToken()}
+		d.skipSpace()
+		attrType := d.readToken()
+		if attrType == "NOTATION" {
+			d.skipSpace()
+			attrType += " " + d.readToken()
+		}
+		attr["type"] = attrType
+		d.skipSpace()
+		if !d.eof() && d.s[d.pos] == '#' {
+			attr["default"] = d.readToken()
+			d.skipSpace()
+		}
+		if attr["default"] == nil || attr["default"] == "#FIXED" {
+			value, err := d.readQuoted()
+			if err != nil {
+				return nil, err
+			}
+			attr["value"] = value
+		}
+		if attr["name"] == "" || attrType == "" {
+			return nil, errors.Errorf("%d文字目: ATTLIST の属性の定義が不正です", d.pos+1)
+		}
+		attributes = append(attributes, attr)
+	}
+}
+
+// parseEntity は ENTITY 宣言の実体名以降を読む。
+func (d *doctypeScanner) parseEntity() (map[string]interface{}, error) {
+	d.skipSpace()
+	decl := map[string]interface{}{"type": DoctypeDeclEntity}
+	if d.consume("%") {
+		decl["parameter"] = true
+		d.skipSpace()
+	}
+	decl["name"] = d.readToken()
+	d.skipSpace()
+	ok, err := d.readExternalID(decl, true)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		value, err := d.readQuoted()
+		if err != nil {
+			return nil, err
+		}
+		decl["value"] = value
+	} else {
+		d.skipSpace()
+		if d.consume("NDATA") {
+			d.skipSpace()
+			decl["notation"] = d.readToken()
+		}
+	}
+	return decl, d.expectDeclEnd("ENTITY")
+}
+
+// doctypeObject は $doctype の値をオブジェクトの形で返す。文字列の場合は解釈する。
+func doctypeObject(value interface{}) (map[string]interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, nil
+	case string:
+		s := strings.TrimSpace(v)
+		if !strings.HasPrefix(s, "<!") || !strings.HasSuffix(s, ">") {
+			return nil, errors.Errorf("DOCTYPE は \"<!DOCTYPE\" で始まり \">\" で終わる必要があります")
+		}
+		return parseDoctype(s[2 : len(s)-1])
+	}
+	return nil, errors.Errorf("DOCTYPE は文字列またはオブジェクトである必要があります（%s）", jsonTypeName(value))
+}
+
+// doctypeString は $doctype の値をXMLの DOCTYPE 宣言にする。文字列はそのまま返す。
+// 構造が不正な場合も、読み取れる項目だけで組み立てる（検証は validateDoctype で行う）。
+func doctypeString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		var b strings.Builder
+		b.WriteString("<!DOCTYPE " + doctypeField(v, "name"))
+		b.WriteString(externalIDString(v))
+		if subset, ok := v["subset"].([]interface{}); ok {
+			b.WriteString(" [")
+			for _, item := range subset {
+				if decl, ok := item.(map[string]interface{}); ok {
+					b.WriteString("\n\t" + doctypeDeclString(decl))
+				}
+			}
+			b.WriteString("\n]")
+		}
+		b.WriteString(">")
+		return b.String()
+	}
+	return ""
+}
+
+// doctypeDeclString は内部サブセットの宣言を1つ文字列にする。
+func doctypeDeclString(decl map[string]interface{}) string {
+	name := doctypeField(decl, "name")
+	switch doctypeField(decl, "type") {
+	case DoctypeDeclElement:
+		return "<!ELEMENT " + name + " " + doctypeField(decl, "content") + ">"
+	case DoctypeDeclAttlist:
+		s := "<!ATTLIST " + name
+		attributes, _ := decl["attributes"].([]interface{})
+		for _, item := range attributes {
+			attr, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			s += " " + doctypeField(attr, "name") + " " + doctypeField(attr, "type")
+			if def := doctypeField(attr, "default"); def != "" {
+				s += " " + def
+			}
+			if _, ok := attr["value"]; ok {
+				s += " " + quoteDoctypeLiteral(doctypeField(attr, "value"))
+			}
+		}
+		return s + ">"
+	case DoctypeDeclEntity:
+		s := "<!ENTITY "
+		if parameter, _ := decl["parameter"].(bool); parameter {
+			s += "% "
+		}
+		s += name
+		if _, ok := decl["value"]; ok {
+			s += " " + quoteDoctypeLiteral(doctypeField(decl, "value"))
+		} else {
+			s += externalIDString(decl)
+			if notation := doctypeField(decl, "notation"); notation != "" {
+				s += " NDATA " + notation
+			}
+		}
+		return s + ">"
+	case DoctypeDeclNotation:
+		return "<!NOTATION " + name + externalIDString(decl) + ">"
+	case DoctypeDeclComment:
+		return "<!--" + doctypeField(decl, "text") + "-->"
+	case DoctypeDeclPI:
+		return "<?" + doctypeField(decl, "target") + " " + doctypeField(decl, "data") + "?>"
+	case DoctypeDeclPERef:
+		return "%" + name + ";"
+	}
+	return ""
+}
+
+// externalIDString は publicId と systemId から " PUBLIC ..." または " SYSTEM ..." を作る。
+func externalIDString(decl map[string]interface{}) string {
+	_, hasPublic := decl["publicId"]
+	_, hasSystem := decl["systemId"]
+	switch {
+	case hasPublic:
+		s := " PUBLIC " + quoteDoctypeLiteral(doctypeField(decl, "publicId"))
+		if hasSystem {
+			s += " " + quoteDoctypeLiteral(doctypeField(decl, "systemId"))
+		}
+		return s
+	case hasSystem:
+		return " SYSTEM " + quoteDoctypeLiteral(doctypeField(decl, "systemId"))
+	}
+	return ""
+}
+
+// quoteDoctypeLiteral は値を二重引用符で囲む。値に二重引用符が含まれる場合は単一引用符で囲む。
+func quoteDoctypeLiteral(value string) string {
+	if strings.Contains(value, `"`) {
+		return "'" + value + "'"
+	}
+	return `"` + value + `"`
+}
+
+func doctypeField(decl map[string]interface{}, key string) string {
+	if value, ok := decl[key]; ok && value != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return ""
+}
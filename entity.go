@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// DOCTYPE の内部サブセットで宣言された実体
+// ---------------------------------------------------------------------
+
+// 実体参照の扱い。
+const (
+	EntitiesExpand = "expand" // 宣言された値に展開する
+	EntitiesKeep   = "keep"   // 実体参照のノードとして残す
+)
+
+// 実体参照を残す場合に、デコーダーが展開した位置を示す目印（Unicode の非文字）。
+const (
+	entityMarkStart = "\uFDD0"
+	entityMarkEnd   = "\uFDD1"
+)
+
+// 展開結果の大きさの上限（実体の入れ子による膨張を防ぐ）。
+const maxEntityExpansion = 1 << 20
+
+var (
+	reEntityRef    = regexp.MustCompile(`&(#[0-9]+|#x[0-9A-Fa-f]+|[^\s&;#]+);`)
+	reEntityMarked = regexp.MustCompile(entityMarkStart + `([^` + entityMarkEnd + `]*)` + entityMarkEnd)
+)
+
+// 実体参照の扱いを返す。
+func currentEntitiesMode() string {
+	if args.Entities == "" {
+		return EntitiesExpand
+	}
+	return strings.ToLower(args.Entities)
+}
+
+// 実体参照の扱いの指定が正しいかを確認する。
+func checkEntitiesMode() error {
+	switch currentEntitiesMode() {
+	case EntitiesExpand, EntitiesKeep:
+		return nil
+	}
+	return errors.Errorf("未対応の実体参照の扱いです: %v", args.Entities)
+}
+
+// parseEntityDeclarations は DOCTYPE の内部サブセットから内部一般実体の宣言を読み取り、展開後の値を返す。
+// パラメーター実体と外部実体（SYSTEM, PUBLIC）は対象外とする。
+func parseEntityDeclarations(doctype map[string]interface{}) (map[string]string, error) {
+	raw := make(map[string]string)
+	var names []string
+	subset, _ := doctype["subset"].([]interface{})
+	for _, item := range subset {
+		decl, ok := item.(map[string]interface{})
+		if !ok || decl["type"] != DoctypeDeclEntity || decl["parameter"] == true {
+			continue
+		}
+		name := doctypeField(decl, "name")
+		value, ok := decl["value"].(string)
+		if !ok {
+			continue
+		}
+		// XMLの規則どおり、同じ名前の実体は最初の宣言を使う。
+		if _, exists := raw[name]; !exists {
+			raw[name] = value
+			names = append(names, name)
+		}
+	}
+
+	entities := make(map[string]string)
+	for _, name := range names {
+		value, err := expandEntityValue(raw[name], raw, map[string]bool{name: true})
+		if err != nil {
+			return nil, errors.Errorf("実体 %q: %v", name, err)
+		}
+		entities[name] = value
+	}
+	return entities, nil
+}
+
+// expandEntityValue は実体の値に含まれる文字参照と実体参照を展開する。
+// expanding は展開中の実体の名前で、再帰的な参照を検出するために使う。
+func expandEntityValue(value string, raw map[string]string, expanding map[string]bool) (string, error) {
+	var err error
+	expanded := reEntityRef.ReplaceAllStringFunc(value, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+		name := ref[1 : len(ref)-1]
+		if strings.HasPrefix(name, "#") {
+			digits, base := name[1:], 10
+			if strings.HasPrefix(digits, "x") {
+				digits, base = digits[1:], 16
+			}
+			code, parseErr := strconv.ParseUint(digits, base, 32)
+			if parseErr != nil {
+				err = errors.Errorf("不正な文字参照です: %s", ref)
+				return ""
+			}
+			return string(rune(code))
+		}
+		if predefined, ok := xmlPredefinedEntities[name]; ok {
+			return predefined
+		}
+		inner, ok := raw[name]
+		if !ok {
+			err = errors.Errorf("宣言されていない実体を参照しています: %s", ref)
+			return ""
+		}
+		if expanding[name] {
+			err = errors.Errorf("実体 %q が再帰的に参照されています", name)
+			return ""
+		}
+		expanding[name] = true
+		defer delete(expanding, name)
+		var result string
+		result, err = expandEntityValue(inner, raw, expanding)
+		return result
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(expanded) > maxEntityExpansion {
+		return "", errors.Errorf("展開結果が大きすぎます（%dバイト）", len(expanded))
+	}
+	return expanded, nil
+}
+
+// XMLの定義済み実体。
+var xmlPredefinedEntities = map[string]string{
+	"amp":  "&",
+	"lt":   "<",
+	"gt":   ">",
+	"quot": `"`,
+	"apos": "'",
+}
+
+// registerEntities は DOCTYPE で宣言された実体をデコーダーに登録する。
+// 実体参照を残す場合は、展開した位置が分かるよう目印で囲んだ実体名を登録する。
+func (r *xmlTokenReader) registerEntities(directive xml.Directive) error {
+	if !isDoctypeDirective(directive) {
+		return nil
+	}
+	doctype, err := parseDoctype(string(directive))
+	if err != nil {
+		return errors.Errorf("DOCTYPE が不正です: %v", err)
+	}
+	entities, err := parseEntityDeclarations(doctype)
+	if err != nil {
+		return errors.Errorf("DOCTYPE の実体宣言が不正です: %v", err)
+	}
+	if len(entities) == 0 {
+		return nil
+	}
+	// xml.HTMLEntity などの共有のマップを書き換えないよう、コピーしてから登録する。
+	merged := make(map[string]string, len(r.decoder.Entity)+len(entities))
+	for name, value := range r.decoder.Entity {
+		merged[name] = value
+	}
+	for name, value := range entities {
+		if currentEntitiesMode() == EntitiesKeep {
+			merged[name] = entityMarkStart + name + entityMarkEnd
+		} else {
+			merged[name] = value
+		}
+	}
+	r.decoder.Entity = merged
+	r.entities = entities
+	return nil
+}
+
+// expandMarkedEntities は目印で囲んだ実体名を値に展開する（属性値では実体参照のノードを表せないため）。
+func (r *xmlTokenReader) expandMarkedEntities(s string) string {
+	if !strings.Contains(s, entityMarkStart) {
+		return s
+	}
+	return reEntityMarked.ReplaceAllStringFunc(s, func(marked string) string {
+		return r.entities[strings.TrimSuffix(strings.TrimPrefix(marked, entityMarkStart), entityMarkEnd)]
+	})
+}
+
+// textWithEntityNodes はテキストに実体参照の目印があれば、文字列と実体参照のノード（{"$entity": 名前}）の配列にする。
+// 目印がなければテキストをそのまま返す。
+func textWithEntityNodes(text string) interface{} {
+	if !strings.Contains(text, entityMarkStart) {
+		return text
+	}
+	var segments []interface{}
+	last := 0
+	for _, loc := range reEntityMarked.FindAllStringSubmatchIndex(text, -1) {
+		if loc[0] > last {
+			segments = append(segments, text[last:loc[0]])
+		}
+		segments = append(segments, map[string]interface{}{keys.Entity(): text[loc[2]:loc[3]]})
+		last = loc[1]
+	}
+	if last < len(text) {
+		segments = append(segments, text[last:])
+	}
+	return segments
+}
+
+// writeTextSegments は文字列と実体参照のノードの配列をXMLのテキストとして書き出す。
+// 文字列は element の $source に記録された書き方があればそれを使う。
+func writeTextSegments(buffer *bytes.Buffer, element map[string]interface{}, segments []interface{}) {
+	for i, segment := range segments {
+		if node, ok := segment.(map[string]interface{}); ok {
+			buffer.WriteString("&" + fmt.Sprintf("%v", node[keys.Entity()]) + ";")
+			continue
+		}
+		buffer.WriteString(xmlTextOutputFor(element, textSegmentKey(i), segment))
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// ---------------------------------------------------------------------
+// 出力形式・入力形式（JSON, YAML, TOML, MessagePack, CBOR, CSV, IDT, SQL）の切り替え
+// ---------------------------------------------------------------------
+
+// 対応している形式名。
+const (
+	FormatJSON    = "json"
+	FormatYAML    = "yaml"
+	FormatTOML    = "toml"
+	FormatMsgPack = "msgpack"
+	FormatCBOR    = "cbor"
+	FormatCSV     = "csv" // table/col/row/td 形式の文書のみ。csv.go を参照
+	FormatIDT     = "idt" // MSI データベースの文書のみ。idt.go を参照
+	FormatSQL     = "sql" // table/col/row/td 形式の文書の出力のみ。sql.go を参照
+)
+
+// 現在の形式名を返す。未指定の場合は json とする。
+func currentFormat() string {
+	switch f := strings.ToLower(args.Format); f {
+	case "":
+		return FormatJSON
+	case "yml":
+		return FormatYAML
+	case "messagepack":
+		return FormatMsgPack
+	default:
+		return f
+	}
+}
+
+// 形式名が対応しているものかどうかを確認する。
+func checkFormat() error {
+	switch currentFormat() {
+	case FormatJSON, FormatYAML, FormatTOML, FormatCSV, FormatIDT:
+		return nil
+	case FormatSQL:
+		if ToXML {
+			return errors.Errorf("SQLからXMLへの変換には対応していません")
+		}
+		return nil
+	case FormatMsgPack, FormatCBOR:
+		// バイナリ形式は改行で区切れないため、1行1レコードでは読み込めない。
+		if ToXML && args.NDJSON {
+			return errors.Errorf("--to-xml --ndjson は --format %s と同時に指定できません", currentFormat())
+		}
+		return nil
+	}
+	return errors.Errorf("未対応の形式です: %v", args.Format)
+}
+
+// isTableDirectoryFormat は、テーブルごとのファイルをディレクトリに入出力する形式かどうかを返す。
+func isTableDirectoryFormat() bool {
+	switch currentFormat() {
+	case FormatCSV, FormatIDT:
+		return true
+	}
+	return false
+}
+
+// isBinaryFormat はバイナリ形式かどうかを返す。バイナリ形式の出力では改行コードを変換しない。
+func isBinaryFormat() bool {
+	switch currentFormat() {
+	case FormatMsgPack, FormatCBOR:
+		return true
+	}
+	return false
+}
+
+// formatFromExtension は拡張子から形式名を返す。XMLや未知の拡張子の場合は空文字列を返す。
+func formatFromExtension(ext string) string {
+	switch strings.ToLower(ext) {
+	case ".json":
+		return FormatJSON
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	case ".msgpack":
+		return FormatMsgPack
+	case ".cbor":
+		return FormatCBOR
+	}
+	return ""
+}
+
+// marshalDocument は内部表現を現在の形式で文字列にする。
+func marshalDocument(v interface{}) ([]byte, error) {
+	switch currentFormat() {
+	case FormatYAML:
+		var buffer bytes.Buffer
+		encoder := yaml.NewEncoder(&buffer)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(v); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	case FormatTOML:
+		if err := checkTOMLValue("", v); err != nil {
+			return nil, err
+		}
+		return toml.Marshal(v)
+	case FormatMsgPack:
+		// 同じ内容からは同じバイト列になるよう、マップのキーを昇順で出力する。
+		var buffer bytes.Buffer
+		encoder := msgpack.NewEncoder(&buffer)
+		encoder.SetSortMapKeys(true)
+		if err := encoder.Encode(v); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	case FormatCBOR:
+		mode, err := cbor.CoreDetEncOptions().EncMode()
+		if err != nil {
+			return nil, err
+		}
+		return mode.Marshal(v)
+	}
+	if args.CanonicalJSON {
+		return marshalCanonicalJSON(v)
+	}
+	if args.Minify {
+		return json.Marshal(v)
+	}
+	return json.MarshalIndent(v, "", "\t")
+}
+
+// unmarshalDocument は現在の形式の文字列を内部表現にする。
+// YAML のスカラー値は、数値や真偽値に見えるものも含めて記述されたままの文字列として読み込む。
+func unmarshalDocument(data []byte) (interface{}, error) {
+	switch currentFormat() {
+	case FormatYAML:
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return nil, err
+		}
+		return yamlNodeToValue(&node)
+	case FormatTOML:
+		var v interface{}
+		if err := toml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		return tomlValueToValue(v), nil
+	case FormatMsgPack:
+		var v interface{}
+		if err := msgpack.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		return binaryValueToValue(v), nil
+	case FormatCBOR:
+		mode, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		if err := mode.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		return binaryValueToValue(v), nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// unmarshalDocumentObject は unmarshalDocument の結果がオブジェクトであることを確認して返す。
+func unmarshalDocumentObject(data []byte) (map[string]interface{}, error) {
+	v, err := unmarshalDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	root, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("トップレベルはオブジェクトである必要があります（%s）", jsonTypeName(v))
+	}
+	return root, nil
+}
+
+// yamlNodeToValue は YAML のノードを、JSON を読み込んだ場合と同じ形の値に変換する。
+func yamlNodeToValue(node *yaml.Node) (interface{}, error) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return yamlNodeToValue(node.Content[0])
+	case yaml.AliasNode:
+		return yamlNodeToValue(node.Alias)
+	case yaml.MappingNode:
+		m := make(map[string]interface{})
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode := node.Content[i]
+			if keyNode.Kind != yaml.ScalarNode {
+				return nil, errors.Errorf("%d行目: マッピングのキーはスカラーである必要があります", keyNode.Line)
+			}
+			// マージキー（<<）は展開する。
+			if keyNode.Tag == "!!merge" {
+				merged, err := yamlNodeToValue(node.Content[i+1])
+				if err != nil {
+					return nil, err
+				}
+				if mm, ok := merged.(map[string]interface{}); ok {
+					for k, v := range mm {
+						if _, exists := m[k]; !exists {
+							m[k] = v
+						}
+					}
+				}
+				continue
+			}
+			value, err := yamlNodeToValue(node.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			m[keyNode.Value] = value
+		}
+		return m, nil
+	case yaml.SequenceNode:
+		arr := make([]interface{}, 0, len(node.Content))
+		for _, child := range node.Content {
+			value, err := yamlNodeToValue(child)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		return arr, nil
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return nil, nil
+		}
+		return node.Value, nil
+	}
+	return nil, errors.Errorf("%d行目: 未対応のYAMLノードです", node.Line)
+}
+
+// checkTOMLValue は値が TOML で表現できるかどうかを確認する。
+// TOML には null がなく、テーブルの配列（[[...]]）とそれ以外の値を同じ配列に混在させることもできないため、これらはエラーとする。
+// path はエラーメッセージ用の JSON Pointer 形式のパス。
+func checkTOMLValue(path string, v interface{}) error {
+	where := path
+	if where == "" {
+		where = "/"
+	}
+	switch val := v.(type) {
+	case nil:
+		return errors.Errorf("%s: TOMLではnullを表現できません", where)
+	case map[string]interface{}:
+		for _, key := range sortedKeys(val) {
+			if err := checkTOMLValue(jsonPointer(path, key), val[key]); err != nil {
+				return err
+			}
+		}
+	case []map[string]interface{}:
+		for i, item := range val {
+			if err := checkTOMLValue(fmt.Sprintf("%s/%d", path, i), item); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		tables := 0
+		for i, item := range val {
+			if _, ok := item.(map[string]interface{}); ok {
+				tables++
+			}
+			if err := checkTOMLValue(fmt.Sprintf("%s/%d", path, i), item); err != nil {
+				return err
+			}
+		}
+		if tables > 0 && tables < len(val) {
+			return errors.Errorf("%s: TOMLではテーブルとそれ以外の値が混在した配列を表現できません", where)
+		}
+	}
+	return nil
+}
+
+// tomlValueToValue は TOML を読み込んだ値を、JSON を読み込んだ場合と同じ形の値に変換する。
+// 数値と日時はXMLのテキストとして扱えるよう文字列にする。
+func tomlValueToValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for key, item := range val {
+			val[key] = tomlValueToValue(item)
+		}
+		return val
+	case []interface{}:
+		for i, item := range val {
+			val[i] = tomlValueToValue(item)
+		}
+		return val
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case float64:
+		return strconv.FormatFloat(val, 'g', -1, 64)
+	case time.Time:
+		return val.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		// toml.LocalDate, toml.LocalTime, toml.LocalDateTime
+		return val.String()
+	}
+	return v
+}
+
+// binaryValueToValue は MessagePack, CBOR を読み込んだ値を、JSON を読み込んだ場合と同じ形の値に変換する。
+// 数値は float64、バイト列は文字列とし、JSONからXMLへの変換と全く同じ結果になるようにする。
+func binaryValueToValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for key, item := range val {
+			val[key] = binaryValueToValue(item)
+		}
+		return val
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for key, item := range val {
+			m[fmt.Sprintf("%v", key)] = binaryValueToValue(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range val {
+			val[i] = binaryValueToValue(item)
+		}
+		return val
+	case []byte:
+		return string(val)
+	case int8:
+		return float64(val)
+	case int16:
+		return float64(val)
+	case int32:
+		return float64(val)
+	case int64:
+		return float64(val)
+	case uint8:
+		return float64(val)
+	case uint16:
+		return float64(val)
+	case uint32:
+		return float64(val)
+	case uint64:
+		return float64(val)
+	case float32:
+		return float64(val)
+	}
+	return v
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// XMLフラグメント（複数のトップレベル要素）の処理
+// ---------------------------------------------------------------------
+
+// parseXMLToRecords はトップレベルの要素ごとに既定の形式の内部表現（レコード）を作成する。
+// 要素の前にあるコメントや処理命令はその要素のレコードに含め、最後の要素の後にあるものは単独のレコードにする。
+func parseXMLToRecords(inputString []byte) []map[string]interface{} {
+	decoder := newXMLTokenReader(inputString)
+	records := []map[string]interface{}{}
+	b := newXMLTreeBuilder()
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(errors.Errorf("XMLのパースに失敗しました: %v", err))
+		}
+		b.handleToken(token, decoder.Source())
+
+		// トップレベルの要素が閉じたら1レコードとする。
+		if _, ok := token.(xml.EndElement); ok && b.depth() == 0 {
+			records = append(records, b.result())
+			b = newXMLTreeBuilder()
+		}
+	}
+	if !b.isEmpty() {
+		records = append(records, b.result())
+	}
+	return records
+}
+
+// marshalJSONRecords はレコードを JSON の配列、または --ndjson 指定時は1行1レコードの JSON Lines にする。
+func marshalJSONRecords(records []map[string]interface{}) ([]byte, error) {
+	if !args.NDJSON {
+		return marshalDocument(records)
+	}
+	var buffer bytes.Buffer
+	for _, record := range records {
+		line, err := marshalJSONLine(record)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(line)
+		buffer.WriteString("\n")
+	}
+	return buffer.Bytes(), nil
+}
+
+// parseJSONRecords は JSON の配列、または JSON Lines（1行1レコード）からレコードを読み込む。
+// --format で JSON 以外の形式を指定した場合は、その形式の配列として読み込む。
+func parseJSONRecords(inputString []byte) ([]map[string]interface{}, error) {
+	if currentFormat() != FormatJSON {
+		return parseDocumentRecords(inputString)
+	}
+	trimmed := bytes.TrimSpace(inputString)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var records []map[string]interface{}
+		if err := json.Unmarshal(trimmed, &records); err != nil {
+			return nil, err
+		}
+		return records, nil
+	}
+
+	records := []map[string]interface{}{}
+	for i, line := range bytes.Split(inputString, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, errors.Errorf("%d行目: %v", i+1, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// parseDocumentRecords は JSON 以外の形式の配列からレコードを読み込む。
+func parseDocumentRecords(inputString []byte) ([]map[string]interface{}, error) {
+	v, err := unmarshalDocument(inputString)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("レコードは配列で指定してください（%s）", jsonTypeName(v))
+	}
+	records := make([]map[string]interface{}, 0, len(items))
+	for i, item := range items {
+		record, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("%d番目のレコードがオブジェクトではありません（%s）", i+1, jsonTypeName(item))
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// 入力XMLのトークンの読み込み（--html 指定時はHTMLとして寛容に読み込む）
+// ---------------------------------------------------------------------
+
+// 開始タグが現れると、直前に開いている要素を暗黙に閉じる要素の組み合わせ（HTMLの終了タグの省略）。
+// キーは新たに開く要素、値は閉じられる要素。
+var htmlImpliedEndTags = map[string][]string{
+	"li":     {"li"},
+	"dt":     {"dt", "dd"},
+	"dd":     {"dt", "dd"},
+	"tr":     {"tr", "td", "th"},
+	"td":     {"td", "th"},
+	"th":     {"td", "th"},
+	"option": {"option"},
+	"p":      {"p"},
+	"div":    {"p"},
+	"ul":     {"p"},
+	"ol":     {"p"},
+	"dl":     {"p"},
+	"table":  {"p"},
+	"pre":    {"p"},
+	"form":   {"p"},
+	"h1":     {"p"},
+	"h2":     {"p"},
+	"h3":     {"p"},
+	"h4":     {"p"},
+	"h5":     {"p"},
+	"h6":     {"p"},
+	"hr":     {"p"},
+}
+
+// 内容をマークアップとして解釈せず、対応する終了タグまでをそのままテキストとする要素。
+var htmlRawTextElements = map[string]bool{
+	"script": true,
+	"style":  true,
+}
+
+// xmlTokenReader は入力のトークンを順に返す。
+// --html 指定時は、非厳格モードでHTMLの文字実体参照（&nbsp; など）を有効にして読み込み、要素名と属性名を小文字にそろえる。
+// 空要素（br, img など）はすぐに閉じ、閉じられていない要素は親の終了タグや入力の終わりで閉じ、対応する開始タグのない終了タグは無視する。
+type xmlTokenReader struct {
+	decoder *xml.Decoder
+	html    bool
+	open    []string    // 開いている要素（--html 指定時のみ）
+	input   *htmlInput  // script, style の内容を読むための入力（--html 指定時のみ）
+	pending []xml.Token // 補った終了タグなど、次に返すトークン
+	eof     bool
+
+	entities map[string]string // DOCTYPE で宣言された実体の値
+
+	recorder *inputRecorder // 入力での書き方を取り出すため、読み込んだ入力を保持する（--html 指定時は nil）
+	source   []byte         // 直前のトークンの入力での書き方（--html 指定時は nil）
+}
+
+// newXMLTokenReader は入力からトークンを読み込む xmlTokenReader を作成する。
+func newXMLTokenReader(inputString []byte) *xmlTokenReader {
+	return newXMLTokenReaderFrom(bytes.NewReader(inputString))
+}
+
+// newXMLTokenReaderFrom は io.Reader から順にトークンを読み込む xmlTokenReader を作成する。
+// 入力は全てを読み込まず、読み進めたトークンの分だけ保持する。
+func newXMLTokenReaderFrom(input io.Reader) *xmlTokenReader {
+	if args.HTML {
+		htmlInput := &htmlInput{r: bufio.NewReader(input)}
+		decoder := xml.NewDecoder(htmlInput)
+		decoder.Strict = false
+		decoder.AutoClose = xml.HTMLAutoClose
+		decoder.Entity = xml.HTMLEntity
+		return &xmlTokenReader{decoder: decoder, html: true, input: htmlInput}
+	}
+	recorder := &inputRecorder{r: input}
+	return &xmlTokenReader{decoder: xml.NewDecoder(recorder), recorder: recorder}
+}
+
+// inputRecorder は入力を読み込みながら、まだトークンの書き方として取り出していない部分を保持する。
+type inputRecorder struct {
+	r    io.Reader
+	buf  []byte
+	base int64 // buf の先頭の入力での位置
+}
+
+func (rec *inputRecorder) Read(p []byte) (int, error) {
+	n, err := rec.r.Read(p)
+	rec.buf = append(rec.buf, p[:n]...)
+	return n, err
+}
+
+// take は入力の start から end までを返し、end より前の部分の保持をやめる。
+// <td/> の終了タグのようにデコーダーが補ったトークンは長さ0になるが、書き方が分かる場合として nil ではなく空のスライスを返す。
+func (rec *inputRecorder) take(start, end int64) []byte {
+	if start < rec.base || end < start || end-rec.base > int64(len(rec.buf)) {
+		return nil
+	}
+	source := make([]byte, end-start)
+	copy(source, rec.buf[start-rec.base:end-rec.base])
+	rec.buf = rec.buf[end-rec.base:]
+	rec.base = end
+	return source
+}
+
+// htmlInput はHTMLの入力をデコーダーに1バイトずつ読ませる。
+// デコーダーは io.ByteReader からは先読みしないため、script, style の開始タグの直後から内容を直接読める。
+type htmlInput struct {
+	r    *bufio.Reader
+	last [2]byte // 直前に読んだ2バイト
+}
+
+func (in *htmlInput) Read(p []byte) (int, error) {
+	n, err := in.r.Read(p)
+	for _, b := range p[:n] {
+		in.last[0], in.last[1] = in.last[1], b
+	}
+	return n, err
+}
+
+func (in *htmlInput) ReadByte() (byte, error) {
+	b, err := in.r.ReadByte()
+	if err == nil {
+		in.last[0], in.last[1] = in.last[1], b
+	}
+	return b, err
+}
+
+// selfClosing は直前に読んだ開始タグが <script/> のように自己終了しているかどうかを返す。
+func (in *htmlInput) selfClosing() bool {
+	return in.last[0] == '/' && in.last[1] == '>'
+}
+
+// readRawText は name の終了タグ（大文字小文字は区別しない）の直前までを読み込み、終了タグは読み飛ばす。
+// 終了タグがなければ入力の終わりまでを返す。
+func (in *htmlInput) readRawText(name string) (string, error) {
+	endTag := "</" + name
+	var text []byte
+	for {
+		b, err := in.ReadByte()
+		if err == io.EOF {
+			return string(text), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		text = append(text, b)
+		if len(text) < len(endTag) || !strings.EqualFold(string(text[len(text)-len(endTag):]), endTag) {
+			continue
+		}
+		// </scripts> のような別の名前は終了タグとしない。
+		next, err := in.r.Peek(1)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if len(next) > 0 && !isHTMLTagNameEnd(next[0]) {
+			continue
+		}
+		text = text[:len(text)-len(endTag)]
+		for {
+			b, err := in.ReadByte()
+			if err == io.EOF || (err == nil && b == '>') {
+				return string(text), nil
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+}
+
+// isHTMLTagNameEnd はタグ名の直後に現れて、名前の終わりを示す文字かどうかを返す。
+func isHTMLTagNameEnd(b byte) bool {
+	switch b {
+	case '>', '/', ' ', '\t', '\r', '\n', '\f':
+		return true
+	}
+	return false
+}
+
+// Token は次のトークンを返す。入力の終わりでは io.EOF を返す。
+// DOCTYPE で宣言された実体は、以降の読み込みで使えるようデコーダーに登録する。
+func (r *xmlTokenReader) Token() (xml.Token, error) {
+	token, err := r.nextToken()
+	if err != nil {
+		return token, err
+	}
+	switch t := token.(type) {
+	case xml.Directive:
+		// 内部サブセットのコメントを残すため、入力での書き方から読み直す。
+		t = rawDirective(t, r.source)
+		token = t
+		if !isDoctypeDirective(t) {
+			return nil, errors.Errorf("DOCTYPE 以外の宣言には対応していません: <!%s>", string(t))
+		}
+		if err := r.registerEntities(t); err != nil {
+			return nil, err
+		}
+	case xml.StartElement:
+		for i := range t.Attr {
+			t.Attr[i].Value = r.expandMarkedEntities(t.Attr[i].Value)
+		}
+	}
+	return token, nil
+}
+
+// nextToken は入力の次のトークンを返す。
+func (r *xmlTokenReader) nextToken() (xml.Token, error) {
+	if !r.html {
+		start := r.decoder.InputOffset()
+		token, err := r.decoder.Token()
+		if err == nil {
+			r.source = r.recorder.take(start, r.decoder.InputOffset())
+		}
+		return token, err
+	}
+	for len(r.pending) == 0 {
+		if r.eof {
+			return nil, io.EOF
+		}
+		if err := r.readHTMLToken(); err != nil {
+			return nil, err
+		}
+	}
+	token := r.pending[0]
+	r.pending = r.pending[1:]
+	return token, nil
+}
+
+// Source は直前に返したトークンの入力での書き方を返す。
+// HTMLとして読み込む場合は、終了タグを補うためトークンと入力が対応しないので nil を返す。
+func (r *xmlTokenReader) Source() []byte {
+	return r.source
+}
+
+// readHTMLToken はHTMLのトークンを1つ読み込み、開始タグと終了タグの対応を補ったトークンを pending に追加する。
+// 開始タグと終了タグの対応は自前で管理するため、検証を行わない RawToken で読み込む。
+func (r *xmlTokenReader) readHTMLToken() error {
+	token, err := r.decoder.RawToken()
+	if err == io.EOF {
+		r.closeHTMLElements(0)
+		r.eof = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch t := token.(type) {
+	case xml.StartElement:
+		t.Name.Local = strings.ToLower(t.Name.Local)
+		for i := range t.Attr {
+			t.Attr[i].Name.Local = strings.ToLower(t.Attr[i].Name.Local)
+		}
+		if closes, ok := htmlImpliedEndTags[t.Name.Local]; ok && len(r.open) > 0 {
+			top := r.open[len(r.open)-1]
+			for _, name := range closes {
+				if top == name {
+					r.closeHTMLElements(len(r.open) - 1)
+					break
+				}
+			}
+		}
+		r.pending = append(r.pending, xml.CopyToken(t))
+		if r.isHTMLVoidElement(t.Name.Local) {
+			r.pending = append(r.pending, xml.EndElement{Name: t.Name})
+		} else if htmlRawTextElements[t.Name.Local] {
+			// script, style の内容は < や && を含むことがあるため、デコーダーを通さずにそのまま読む。
+			// 自己終了タグの場合、終了タグはデコーダーが補う。
+			if r.input.selfClosing() {
+				r.open = append(r.open, t.Name.Local)
+				return nil
+			}
+			text, err := r.input.readRawText(t.Name.Local)
+			if err != nil {
+				return err
+			}
+			if text != "" {
+				r.pending = append(r.pending, xml.CharData(text))
+			}
+			r.pending = append(r.pending, xml.EndElement{Name: t.Name})
+		} else {
+			r.open = append(r.open, t.Name.Local)
+		}
+	case xml.EndElement:
+		name := strings.ToLower(t.Name.Local)
+		// 開いている要素のうち最も内側の同名の要素まで閉じる。見つからない終了タグは無視する。
+		for i := len(r.open) - 1; i >= 0; i-- {
+			if r.open[i] == name {
+				r.closeHTMLElements(i)
+				break
+			}
+		}
+	default:
+		r.pending = append(r.pending, xml.CopyToken(token))
+	}
+	return nil
+}
+
+// closeHTMLElements は開いている要素のうち、depth 番目以降を内側から順に閉じる。
+func (r *xmlTokenReader) closeHTMLElements(depth int) {
+	for i := len(r.open) - 1; i >= depth; i-- {
+		r.pending = append(r.pending, xml.EndElement{Name: xml.Name{Local: r.open[i]}})
+	}
+	r.open = r.open[:depth]
+}
+
+// isHTMLVoidElement は内容を持たない要素（br, img など）かどうかを返す。
+func (r *xmlTokenReader) isHTMLVoidElement(name string) bool {
+	for _, void := range r.decoder.AutoClose {
+		if void == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+// --html 指定時、script と style の内容は < や && を含んでもそのままテキストとして読み込むことを確認する。
+func TestHTMLRawTextElements(t *testing.T) {
+	saved := args.HTML
+	args.HTML = true
+	defer func() { args.HTML = saved }()
+
+	root := parseXMLToMap([]byte(`<html><head><script>if (a < b && c) { x = "</p>"; }</SCRIPT><style>a > b { }</style><script src="x.js"/></head><body><p>ok</p></body></html>`))
+	head := root["html"].(map[string]interface{})["head"].(map[string]interface{})
+
+	scripts := asElementArray(head["script"])
+	if len(scripts) != 2 {
+		t.Fatalf("script の数 = %d, want 2", len(scripts))
+	}
+	if got, want := elementText(scripts[0]), `if (a < b && c) { x = "</p>"; }`; got != want {
+		t.Errorf("script = %q, want %q", got, want)
+	}
+	if got, want := elementText(head["style"]), "a > b { }"; got != want {
+		t.Errorf("style = %q, want %q", got, want)
+	}
+	body := root["html"].(map[string]interface{})["body"].(map[string]interface{})
+	if got := elementText(body["p"]); got != "ok" {
+		t.Errorf("p = %q, want \"ok\"", got)
+	}
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// ---------------------------------------------------------------------
+// MSI データベースのテーブルと IDT ファイルの相互変換
+// ---------------------------------------------------------------------
+
+// IDT ファイルの内容。
+// 1行目は列名、2行目は列の型定義（s72, I2 など）、3行目は（コードページ、）テーブル名と主キーの列名。
+type idtTable struct {
+	name     string
+	codepage string
+	columns  []string
+	types    []string
+	keys     []string
+	rows     [][]string
+}
+
+// サマリー情報を格納する IDT ファイルのテーブル名。
+const idtSummaryTableName = "_SummaryInformation"
+
+// サマリー情報のプロパティID と summary 要素の子要素名の対応。
+var idtSummaryProperties = []struct {
+	id   int
+	name string
+}{
+	{1, "codepage"},
+	{2, "title"},
+	{3, "subject"},
+	{4, "author"},
+	{5, "keywords"},
+	{6, "comments"},
+	{7, "template"},
+	{8, "lastauthor"},
+	{9, "revnumber"},
+	{11, "lastprinted"},
+	{12, "createdtm"},
+	{13, "lastsavedtm"},
+	{14, "pagecount"},
+	{15, "wordcount"},
+	{16, "charcount"},
+	{18, "appname"},
+	{19, "security"},
+}
+
+// IDT ファイルでは値の中のタブと改行を制御文字に置き換える。
+var (
+	idtEscaper   = strings.NewReplacer("\t", "\x15", "\r", "\x11", "\n", "\x19")
+	idtUnescaper = strings.NewReplacer("\x15", "\t", "\x11", "\r", "\x19", "\n")
+)
+
+// ConvertXMLToIDT は table 要素ごとに「テーブル名.idt」を outputDir に書き出す。
+// 列の型定義と主キーは col 要素の def 属性と key 属性から作る。summary 要素は _SummaryInformation.idt に書き出す。
+// テーブルの行を除いた文書全体は document.json に保存し、ConvertIDTToXML で元のXMLに戻せるようにする。
+func ConvertXMLToIDT(inputString []byte, outputDir string) {
+	if outputDir == "" {
+		panic(errors.Errorf("--format idt では出力先のディレクトリを -o で指定してください"))
+	}
+	root := parseXMLToMap(inputString)
+	if err := checkTableDocument(root); err != nil {
+		panic(err)
+	}
+	_, database := tableDocumentRoot(root)
+	codepage := idtDatabaseCodepage(database)
+	enc, err := codepageEncoding(codepage)
+	if err != nil {
+		panic(err)
+	}
+
+	var tables []*idtTable
+	names := make(map[string]bool)
+	err = walkTables(root, func(table map[string]interface{}) error {
+		name, err := tableFileName(table)
+		if err != nil {
+			return err
+		}
+		if names[name] {
+			return errors.Errorf("テーブル %q が複数あります", name)
+		}
+		names[name] = true
+		t, err := tableToIDT(name, table)
+		if err != nil {
+			return err
+		}
+		t.codepage = codepage
+		tables = append(tables, t)
+		// 行は IDT ファイルに書き出すため、document.json には含めない。
+		delete(table, "row")
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if len(tables) == 0 {
+		panic(errors.Errorf("table 要素がありません"))
+	}
+	if summary, ok := database["summary"].(map[string]interface{}); ok {
+		t, err := summaryToIDT(summary)
+		if err != nil {
+			panic(err)
+		}
+		t.codepage = codepage
+		tables = append(tables, t)
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		panic(errors.Errorf("出力ディレクトリを作成できません: %v", err))
+	}
+	for _, t := range tables {
+		if err := writeIDTFile(filepath.Join(outputDir, t.name+".idt"), t, enc); err != nil {
+			panic(errors.Errorf("テーブル %q の IDT ファイルの書き込みに失敗しました: %v", t.name, err))
+		}
+	}
+
+	writeTableDocumentJSON(outputDir, root)
+}
+
+// ConvertIDTToXML は inputDir の IDT ファイルからXMLを組み立てる。
+// document.json がある場合はそのテーブルに行を戻し、ない場合は IDT ファイルの列定義から msi 文書を新たに作る。
+func ConvertIDTToXML(inputDir string, output io.Writer) {
+	if inputDir == "" {
+		panic(errors.Errorf("--format idt では入力元のディレクトリを -i で指定してください"))
+	}
+	files, err := filepath.Glob(filepath.Join(inputDir, "*.idt"))
+	if err != nil {
+		panic(errors.Errorf("IDT ファイルを探せません: %v", err))
+	}
+	tables := make(map[string]*idtTable)
+	for _, file := range files {
+		t, err := readIDTFile(file)
+		if err != nil {
+			panic(errors.Errorf("%s: %v", filepath.Base(file), err))
+		}
+		if _, exists := tables[t.name]; exists {
+			panic(errors.Errorf("テーブル %q の IDT ファイルが複数あります", t.name))
+		}
+		tables[t.name] = t
+	}
+
+	root, err := readTableDocumentJSON(inputDir)
+	if err != nil {
+		panic(err)
+	}
+	if root == nil {
+		root = newIDTDocument(tables)
+	}
+
+	found := make(map[string]bool)
+	err = walkTables(root, func(table map[string]interface{}) error {
+		name, err := tableFileName(table)
+		if err != nil {
+			return err
+		}
+		t, ok := tables[name]
+		if !ok {
+			return errors.Errorf("テーブル %q の IDT ファイルがありません", name)
+		}
+		if err := idtToTable(t, table); err != nil {
+			return err
+		}
+		found[name] = true
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	for _, name := range sortedTableNames(tables) {
+		if found[name] {
+			continue
+		}
+		if name != idtSummaryTableName {
+			panic(errors.Errorf("%s.idt に対応するテーブルが %s にありません", name, tableDocumentFileName))
+		}
+		rootName, database := tableDocumentRoot(root)
+		if database == nil {
+			panic(errors.Errorf("サマリー情報を格納する要素がありません"))
+		}
+		if err := idtToSummary(tables[name], database, rootName, root); err != nil {
+			panic(err)
+		}
+	}
+
+	writeTableDocumentXML(output, root)
+}
+
+// tableDocumentRoot は文書のルート要素の名前と内容を返す。
+func tableDocumentRoot(root map[string]interface{}) (string, map[string]interface{}) {
+	for _, key := range sortedKeys(root) {
+		if keys.IsElement(key) {
+			if element, ok := root[key].(map[string]interface{}); ok {
+				return key, element
+			}
+		}
+	}
+	return "", nil
+}
+
+// idtDatabaseCodepage はデータベースのコードページを返す。
+// ルート要素の codepage 属性、なければ summary 要素の codepage を使う。
+func idtDatabaseCodepage(database map[string]interface{}) string {
+	if database == nil {
+		return ""
+	}
+	if codepage, ok := database[keys.Attr("codepage")]; ok {
+		return fmt.Sprintf("%v", codepage)
+	}
+	if summary, ok := database["summary"].(map[string]interface{}); ok {
+		if codepage, ok := summary["codepage"]; ok {
+			return elementText(codepage)
+		}
+	}
+	return ""
+}
+
+// codepageEncoding は Windows のコードページ番号に対応する文字エンコーディングを返す。
+// コードページの指定がない場合と 65001 の場合は UTF-8 のまま扱うため nil を返す。
+func codepageEncoding(codepage string) (encoding.Encoding, error) {
+	switch codepage {
+	case "", "0", "65001":
+		return nil, nil
+	case "932":
+		return japanese.ShiftJIS, nil
+	case "936":
+		return simplifiedchinese.GBK, nil
+	case "949":
+		return korean.EUCKR, nil
+	case "950":
+		return traditionalchinese.Big5, nil
+	case "874":
+		return charmap.Windows874, nil
+	case "1250":
+		return charmap.Windows1250, nil
+	case "1251":
+		return charmap.Windows1251, nil
+	case "1252":
+		return charmap.Windows1252, nil
+	case "1253":
+		return charmap.Windows1253, nil
+	case "1254":
+		return charmap.Windows1254, nil
+	case "1255":
+		return charmap.Windows1255, nil
+	case "1256":
+		return charmap.Windows1256, nil
+	case "1257":
+		return charmap.Windows1257, nil
+	case "1258":
+		return charmap.Windows1258, nil
+	}
+	return nil, errors.Errorf("未対応のコードページです: %s", codepage)
+}
+
+// tableToIDT は table 要素を IDT ファイルの内容に変換する。
+// 二進データの列（型 v0, V0）の td は href 属性の値（ストリームのファイル名）を値とする。
+func tableToIDT(name string, table map[string]interface{}) (*idtTable, error) {
+	t := &idtTable{name: name}
+	for i, col := range asElementArray(table["col"]) {
+		colMap, _ := col.(map[string]interface{})
+		def, ok := colMap[keys.Attr("def")]
+		if !ok {
+			return nil, errors.Errorf("テーブル %q の %d列目に def 属性がありません", name, i+1)
+		}
+		column := elementText(col)
+		t.columns = append(t.columns, column)
+		t.types = append(t.types, fmt.Sprintf("%v", def))
+		if key, ok := colMap[keys.Attr("key")]; ok && fmt.Sprintf("%v", key) == "yes" {
+			t.keys = append(t.keys, column)
+		}
+	}
+	for i, row := range asElementArray(table["row"]) {
+		rowMap, _ := row.(map[string]interface{})
+		var record []string
+		for j, td := range asElementArray(rowMap["td"]) {
+			value := elementText(td)
+			if tdMap, ok := td.(map[string]interface{}); ok {
+				for key, v := range tdMap {
+					switch {
+					case key == keys.Text, key == keys.AttrOrder(), isSourceMeta(key):
+					case key == keys.Attr("href"):
+						value = fmt.Sprintf("%v", v)
+					default:
+						return nil, errors.Errorf("テーブル %q の %d行目 %d列目: IDT で表現できない属性や子要素があります（%s）", name, i+1, j+1, key)
+					}
+				}
+			}
+			record = append(record, value)
+		}
+		t.rows = append(t.rows, record)
+	}
+	return t, nil
+}
+
+// idtToTable は IDT ファイルの行を table 要素の row として設定する。列名は col の内容と一致している必要がある。
+func idtToTable(t *idtTable, table map[string]interface{}) error {
+	columns := tableColumnNames(table)
+	if strings.Join(t.columns, "\t") != strings.Join(columns, "\t") {
+		return errors.Errorf("テーブル %q の IDT ファイルの列名 %q が列の定義 %q と一致しません", t.name, t.columns, columns)
+	}
+	rows := make([]interface{}, 0, len(t.rows))
+	for _, record := range t.rows {
+		tds := make([]interface{}, 0, len(record))
+		for i, value := range record {
+			td := make(map[string]interface{})
+			if value != "" {
+				if i < len(t.types) && isIDTBinaryType(t.types[i]) {
+					td[keys.Attr("href")] = value
+				} else {
+					td[keys.Text] = value
+				}
+			}
+			tds = append(tds, td)
+		}
+		rows = append(rows, map[string]interface{}{"td": tds})
+	}
+	if len(rows) > 0 {
+		table["row"] = rows
+	}
+	return nil
+}
+
+// 二進データ（ストリーム）の列の型かどうか。
+func isIDTBinaryType(columnType string) bool {
+	return strings.HasPrefix(columnType, "v") || strings.HasPrefix(columnType, "V")
+}
+
+// summaryToIDT は summary 要素を _SummaryInformation テーブルの IDT ファイルの内容に変換する。
+func summaryToIDT(summary map[string]interface{}) (*idtTable, error) {
+	t := &idtTable{
+		name:    idtSummaryTableName,
+		columns: []string{"PropertyId", "Value"},
+		types:   []string{"i2", "l255"},
+		keys:    []string{"PropertyId"},
+	}
+	known := make(map[string]bool)
+	for _, p := range idtSummaryProperties {
+		known[p.name] = true
+		if value, ok := summary[p.name]; ok {
+			t.rows = append(t.rows, []string{strconv.Itoa(p.id), elementText(value)})
+		}
+	}
+	for _, key := range sortedKeys(summary) {
+		if keys.IsElement(key) && !known[key] {
+			return nil, errors.Errorf("summary の %q に対応するサマリー情報のプロパティがありません", key)
+		}
+	}
+	return t, nil
+}
+
+// idtToSummary は _SummaryInformation テーブルの値を summary 要素に設定する。
+func idtToSummary(t *idtTable, database map[string]interface{}, rootName string, root map[string]interface{}) error {
+	names := make(map[string]string)
+	for _, p := range idtSummaryProperties {
+		names[strconv.Itoa(p.id)] = p.name
+	}
+	summary, ok := database["summary"].(map[string]interface{})
+	if !ok {
+		summary = make(map[string]interface{})
+		database["summary"] = summary
+	}
+	for i, record := range t.rows {
+		if len(record) < 2 {
+			return errors.Errorf("%s.idt の %d行目: 列が足りません", t.name, i+1)
+		}
+		name, ok := names[record[0]]
+		if !ok {
+			return errors.Errorf("%s.idt の %d行目: 未知のプロパティID %q です", t.name, i+1, record[0])
+		}
+		summary[name] = map[string]interface{}{keys.Text: record[1]}
+	}
+
+	// summary の子要素の並び順は $orderMap に従うため、プロパティID順で記録する。
+	orderMap, ok := root[keys.OrderMap()].(map[string]interface{})
+	if !ok {
+		orderMap = make(map[string]interface{})
+		root[keys.OrderMap()] = orderMap
+	}
+	path := rootName + "/summary"
+	if _, exists := orderMap[path]; !exists {
+		var order []interface{}
+		for _, p := range idtSummaryProperties {
+			if _, ok := summary[p.name]; ok {
+				order = append(order, p.name)
+			}
+		}
+		orderMap[path] = order
+	}
+	return nil
+}
+
+// newIDTDocument は document.json がない場合に、IDT ファイルの列定義から msi 文書を作る。
+func newIDTDocument(tables map[string]*idtTable) map[string]interface{} {
+	var tableElements []interface{}
+	for _, name := range sortedTableNames(tables) {
+		t := tables[name]
+		if name == idtSummaryTableName {
+			continue
+		}
+		isKey := make(map[string]bool)
+		for _, key := range t.keys {
+			isKey[key] = true
+		}
+		var cols []interface{}
+		for i, column := range t.columns {
+			col := map[string]interface{}{keys.Text: column}
+			var attrOrder []interface{}
+			if isKey[column] {
+				col[keys.Attr("key")] = "yes"
+				attrOrder = append(attrOrder, keys.Attr("key"))
+			}
+			if i < len(t.types) {
+				col[keys.Attr("def")] = t.types[i]
+				attrOrder = append(attrOrder, keys.Attr("def"))
+			}
+			col[keys.AttrOrder()] = attrOrder
+			cols = append(cols, col)
+		}
+		tableElements = append(tableElements, map[string]interface{}{
+			keys.Attr("name"): name,
+			"col":             cols,
+		})
+	}
+
+	database := map[string]interface{}{
+		"table": tableElements,
+	}
+	// IDT ファイルのコードページは、ルート要素の codepage 属性として残す。
+	for _, name := range sortedTableNames(tables) {
+		if codepage := tables[name].codepage; codepage != "" {
+			database[keys.Attr("codepage")] = codepage
+			break
+		}
+	}
+
+	return map[string]interface{}{
+		keys.PI(): []interface{}{
+			map[string]interface{}{"target": "xml", "data": `version="1.0" encoding="UTF-8"`},
+		},
+		keys.OrderMap(): map[string]interface{}{
+			"msi": []interface{}{"summary", "table"},
+		},
+		"msi": database,
+	}
+}
+
+// IDT ファイルのテーブル名を昇順で返す。
+func sortedTableNames(tables map[string]*idtTable) []string {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeIDTFile は IDT ファイルを、タブ区切り、CRLF 改行、コードページの文字エンコーディングで書き出す。
+func writeIDTFile(path string, t *idtTable, enc encoding.Encoding) error {
+	var buffer bytes.Buffer
+	writeLine := func(fields []string) {
+		for i, field := range fields {
+			if i > 0 {
+				buffer.WriteString("\t")
+			}
+			buffer.WriteString(idtEscaper.Replace(field))
+		}
+		buffer.WriteString("\r\n")
+	}
+	writeLine(t.columns)
+	writeLine(t.types)
+	header := append([]string{t.name}, t.keys...)
+	if t.codepage != "" {
+		header = append([]string{t.codepage}, header...)
+	}
+	writeLine(header)
+	for _, row := range t.rows {
+		writeLine(row)
+	}
+
+	data := buffer.Bytes()
+	if enc != nil {
+		encoded, err := enc.NewEncoder().Bytes(data)
+		if err != nil {
+			return errors.Errorf("コードページ %s で表現できない文字があります: %v", t.codepage, err)
+		}
+		data = encoded
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// splitIDTLines は IDT ファイルの内容を行に分ける。行末の \r は各行の読み取り時に取り除く。
+// 全ての列が空の行も行として残すため、取り除くのは最後の行の改行だけとする。
+func splitIDTLines(s string) []string {
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// readIDTFile は IDT ファイルを読み込む。3行目の先頭にコードページがあれば、その文字エンコーディングで復号する。
+func readIDTFile(path string) (*idtTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := splitIDTLines(string(data))
+	if len(lines) < 3 {
+		return nil, errors.Errorf("IDT ファイルには列名、型定義、テーブル名の3行が必要です")
+	}
+
+	// 3行目はASCIIのみのため、復号前に読み取れる。
+	t := &idtTable{}
+	header := strings.Split(strings.TrimSuffix(lines[2], "\r"), "\t")
+	if _, err := strconv.Atoi(header[0]); err == nil && len(header) > 1 {
+		t.codepage = header[0]
+		header = header[1:]
+	}
+	t.name = header[0]
+	t.keys = header[1:]
+
+	enc, err := codepageEncoding(t.codepage)
+	if err != nil {
+		return nil, err
+	}
+	if enc != nil {
+		decoded, err := enc.NewDecoder().Bytes(data)
+		if err != nil {
+			return nil, errors.Errorf("コードページ %s として復号できません: %v", t.codepage, err)
+		}
+		lines = splitIDTLines(string(decoded))
+	}
+
+	splitLine := func(line string) []string {
+		fields := strings.Split(strings.TrimSuffix(line, "\r"), "\t")
+		for i := range fields {
+			fields[i] = idtUnescaper.Replace(fields[i])
+		}
+		return fields
+	}
+	t.columns = splitLine(lines[0])
+	t.types = splitLine(lines[1])
+	for _, line := range lines[3:] {
+		row := splitLine(line)
+		// 末尾の空の列は省略されている場合がある。
+		for len(row) < len(t.columns) {
+			row = append(row, "")
+		}
+		t.rows = append(t.rows, row)
+	}
+	return t, nil
+}
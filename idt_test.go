@@ -0,0 +1,27 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// 全ての列が空の行がファイルの末尾にあっても、IDT ファイルを経由して失われないことを確認する。
+func TestIDTRoundTripKeepsTrailingEmptyRows(t *testing.T) {
+	for _, table := range []*idtTable{
+		{name: "Single", columns: []string{"Value"}, types: []string{"S0"}, keys: []string{"Value"}, rows: [][]string{{"a"}, {""}, {""}}},
+		{name: "Pair", columns: []string{"Key", "Value"}, types: []string{"s72", "S0"}, keys: []string{"Key"}, rows: [][]string{{"k", "v"}, {"", ""}}},
+	} {
+		path := filepath.Join(t.TempDir(), table.name+".idt")
+		if err := writeIDTFile(path, table, nil); err != nil {
+			t.Fatal(err)
+		}
+		read, err := readIDTFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(read.rows, table.rows) {
+			t.Errorf("テーブル %s の行 = %q, want %q", table.name, read.rows, table.rows)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// JSONの予約キー
+// ---------------------------------------------------------------------
+
+// ReservedKeys はJSON表現で使う予約キーの設定。
+type ReservedKeys struct {
+	AttrPrefix   string // 属性名の接頭辞
+	Text         string // テキスト内容のキー
+	MetaPrefix   string // $attrOrder, $comment などのメタデータキーの接頭辞
+	EscapePrefix string // 予約キーと衝突する要素名に付ける接頭辞
+}
+
+// グローバル変数。
+var (
+	keys = ReservedKeys{
+		AttrPrefix:   "@",
+		Text:         "$",
+		MetaPrefix:   "$",
+		EscapePrefix: "~",
+	}
+	reEncodedXMLNameChar = regexp.MustCompile(`_x([0-9A-Fa-f]{4}|[0-9A-Fa-f]{8})_`)
+)
+
+// メタデータキーの名前（接頭辞を除いた部分）。
+const (
+	metaAttrOrder = "attrOrder"
+	metaOrderMap  = "orderMap"
+	metaComment   = "comment"
+	metaPI        = "pi"
+	metaDoctype   = "doctype"
+	metaCDATA     = "cdata"
+	metaRaw       = "raw"
+	metaEntity    = "entity"
+	metaSource    = "source"
+	metaQuote     = "quote"
+	metaEmpty     = "empty"
+	metaNodeOrder = "nodeOrder"
+)
+
+func (k ReservedKeys) AttrOrder() string { return k.MetaPrefix + metaAttrOrder }
+func (k ReservedKeys) OrderMap() string  { return k.MetaPrefix + metaOrderMap }
+func (k ReservedKeys) Comment() string   { return k.MetaPrefix + metaComment }
+func (k ReservedKeys) PI() string        { return k.MetaPrefix + metaPI }
+func (k ReservedKeys) Doctype() string   { return k.MetaPrefix + metaDoctype }
+func (k ReservedKeys) CDATA() string     { return k.MetaPrefix + metaCDATA }
+func (k ReservedKeys) Raw() string       { return k.MetaPrefix + metaRaw }
+func (k ReservedKeys) Entity() string    { return k.MetaPrefix + metaEntity }
+func (k ReservedKeys) Source() string    { return k.MetaPrefix + metaSource }
+func (k ReservedKeys) Quote() string     { return k.MetaPrefix + metaQuote }
+func (k ReservedKeys) Empty() string     { return k.MetaPrefix + metaEmpty }
+func (k ReservedKeys) NodeOrder() string { return k.MetaPrefix + metaNodeOrder }
+
+// Attr は属性名からJSONのキーを作成する。
+func (k ReservedKeys) Attr(name string) string { return k.AttrPrefix + name }
+
+// Xmlns は名前空間宣言をまとめるキーを返す。
+func (k ReservedKeys) Xmlns() string { return k.AttrPrefix + "xmlns" }
+
+// IsAttr はキーが属性を表すかどうかを返す。
+func (k ReservedKeys) IsAttr(key string) bool { return strings.HasPrefix(key, k.AttrPrefix) }
+
+// IsMeta はキーがテキストまたは既知のメタデータキーかどうかを返す。
+func (k ReservedKeys) IsMeta(key string) bool {
+	if key == k.Text {
+		return true
+	}
+	if !strings.HasPrefix(key, k.MetaPrefix) {
+		return false
+	}
+	switch strings.TrimPrefix(key, k.MetaPrefix) {
+	case metaAttrOrder, metaOrderMap, metaComment, metaPI, metaDoctype, metaCDATA, metaRaw, metaEntity, metaSource, metaQuote, metaEmpty, metaNodeOrder:
+		return true
+	}
+	return false
+}
+
+// IsElement はキーが子要素を表すかどうかを返す。属性と既知のメタデータキー以外はすべて子要素として扱う。
+func (k ReservedKeys) IsElement(key string) bool {
+	return !k.IsAttr(key) && !k.IsMeta(key)
+}
+
+// EscapeName は要素名が予約キーと衝突する場合にエスケープ接頭辞を付ける。
+func (k ReservedKeys) EscapeName(name string) string {
+	if name == k.Text ||
+		strings.HasPrefix(name, k.AttrPrefix) ||
+		strings.HasPrefix(name, k.MetaPrefix) ||
+		strings.HasPrefix(name, k.EscapePrefix) {
+		return k.EscapePrefix + name
+	}
+	return name
+}
+
+// UnescapeName は EscapeName の逆変換を行い、JSONのキーから要素名を取り出す。
+func (k ReservedKeys) UnescapeName(key string) string {
+	return strings.TrimPrefix(key, k.EscapePrefix)
+}
+
+// Validate は設定が矛盾していないかを確認する。
+func (k ReservedKeys) Validate() error {
+	if k.AttrPrefix == "" || k.Text == "" || k.MetaPrefix == "" || k.EscapePrefix == "" {
+		return errors.Errorf("予約キーの接頭辞とテキストキーは空にできません")
+	}
+	if strings.HasPrefix(k.AttrPrefix, k.MetaPrefix) || strings.HasPrefix(k.MetaPrefix, k.AttrPrefix) {
+		return errors.Errorf("属性の接頭辞 %q とメタデータの接頭辞 %q は区別できる必要があります", k.AttrPrefix, k.MetaPrefix)
+	}
+	if strings.HasPrefix(k.Text, k.AttrPrefix) {
+		return errors.Errorf("テキストキー %q が属性の接頭辞 %q で始まっています", k.Text, k.AttrPrefix)
+	}
+	for _, prefix := range []string{k.AttrPrefix, k.MetaPrefix} {
+		if strings.HasPrefix(k.EscapePrefix, prefix) || strings.HasPrefix(prefix, k.EscapePrefix) {
+			return errors.Errorf("エスケープ接頭辞 %q が他の接頭辞 %q と重なっています", k.EscapePrefix, prefix)
+		}
+	}
+	return nil
+}
+
+// コマンドライン引数から予約キーを設定する。
+func setupReservedKeys() error {
+	if args.AttrPrefix != "" {
+		keys.AttrPrefix = args.AttrPrefix
+	}
+	if args.TextKey != "" {
+		keys.Text = args.TextKey
+	}
+	if args.MetaPrefix != "" {
+		keys.MetaPrefix = args.MetaPrefix
+	}
+	if args.EscapePrefix != "" {
+		keys.EscapePrefix = args.EscapePrefix
+	}
+	return keys.Validate()
+}
+
+// ---------------------------------------------------------------------
+// XMLの名前として使えない文字のエンコード
+// ---------------------------------------------------------------------
+
+// XMLの名前の先頭に使える文字かどうか。
+func isXMLNameStartChar(r rune) bool {
+	return r == '_' || r == ':' || unicode.IsLetter(r) || (r > 0x7F && !unicode.IsSpace(r) && !unicode.IsPunct(r) && !unicode.IsSymbol(r))
+}
+
+// XMLの名前の2文字目以降に使える文字かどうか。
+func isXMLNameChar(r rune) bool {
+	return isXMLNameStartChar(r) || r == '-' || r == '.' || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) || r == 0xB7
+}
+
+// isValidXMLName は文字列がXMLの名前として使えるかどうかを返す。
+func isValidXMLName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if i == 0 && !isXMLNameStartChar(r) {
+			return false
+		}
+		if !isXMLNameChar(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeXMLName はXMLの名前として使えない文字を _xHHHH_ 形式に置き換える（.NET の XmlConvert.EncodeName と同じ形式）。
+// 既に有効な名前はそのまま返す。
+func encodeXMLName(name string) string {
+	if isValidXMLName(name) {
+		return name
+	}
+	var sb strings.Builder
+	for i, r := range name {
+		valid := isXMLNameChar(r)
+		if i == 0 {
+			valid = isXMLNameStartChar(r)
+		}
+		// 元の名前に含まれる _xHHHH_ 形式の文字列は、復号時に区別できるよう "_" をエンコードする。
+		if loc := reEncodedXMLNameChar.FindStringIndex(name[i:]); r == '_' && loc != nil && loc[0] == 0 {
+			valid = false
+		}
+		if valid {
+			sb.WriteRune(r)
+		} else if r > 0xFFFF {
+			sb.WriteString(fmt.Sprintf("_x%08X_", r))
+		} else {
+			sb.WriteString(fmt.Sprintf("_x%04X_", r))
+		}
+	}
+	return sb.String()
+}
+
+// decodeXMLName は encodeXMLName の逆変換を行う。
+// 復号結果が有効なXMLの名前になる場合は、元から _xHHHH_ を含む名前とみなしてそのまま返す。
+func decodeXMLName(name string) string {
+	if !strings.Contains(name, "_x") {
+		return name
+	}
+	decoded := reEncodedXMLNameChar.ReplaceAllStringFunc(name, func(s string) string {
+		code, err := strconv.ParseUint(s[2:len(s)-1], 16, 32)
+		if err != nil {
+			return s
+		}
+		return string(rune(code))
+	})
+	if decoded == name || isValidXMLName(decoded) {
+		return name
+	}
+	return decoded
+}
+
+// jsonKeyFromXMLName はXMLの要素名（名前空間とローカル名）をJSONのキーに変換する。
+func jsonKeyFromXMLName(space string, local string) string {
+	name := decodeXMLName(local)
+	if space != "" {
+		name = space + ":" + name
+	}
+	return keys.EscapeName(name)
+}
+
+// xmlNameFromJSONKey はJSONのキーをXMLの要素名に変換する。
+func xmlNameFromJSONKey(key string) string {
+	return encodeQualifiedXMLName(keys.UnescapeName(key))
+}
+
+// attrNameFromJSONKey は属性のJSONのキー（接頭辞付き）をXMLの属性名に変換する。
+func attrNameFromJSONKey(key string) string {
+	return encodeQualifiedXMLName(strings.TrimPrefix(key, keys.AttrPrefix))
+}
+
+// "プレフィックス:ローカル名" の形式の場合はローカル名のみをエンコードする。
+func encodeQualifiedXMLName(name string) string {
+	if idx := strings.LastIndex(name, ":"); idx > 0 && idx < len(name)-1 {
+		return name[:idx+1] + encodeXMLName(name[idx+1:])
+	}
+	return encodeXMLName(name)
+}
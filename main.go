@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
@@ -32,7 +31,7 @@ func main() {
 	var output io.Writer
 	var err error
 
-	if len(os.Args) == 2 {
+	if len(os.Args) == 2 && os.Args[1] != "query" {
 		args.InputFile = os.Args[1]
 
 		var input *os.File
@@ -49,7 +48,8 @@ func main() {
 
 		if e := strings.ToLower(filepath.Ext(args.InputFile)); e == ".xml" {
 			args.OutputFile = args.InputFile + ".json"
-		} else if e == ".json" {
+		} else if f := formatFromExtension(e); f != "" {
+			args.Format = f
 			args.OutputFile = args.InputFile + ".xml"
 			ToXML = true
 		}
@@ -73,24 +73,56 @@ func main() {
 			fmt.Fprintf(os.Stderr, "変換モード: %s\n", map[bool]string{false: "XMLからJSON", true: "JSONからXML"}[args.ToXML])
 		}
 
-		if len(args.InputFile) == 0 && len(os.Args) == 1 {
-			// 標準入力から読み取り、標準出力に出力する。
-			inputString, err = io.ReadAll(os.Stdin)
-			if err != nil {
-				panic(errors.Errorf("標準入力の読み込みに失敗しました: %v", err))
-			}
-		} else {
-			var input *os.File
-			input, err = os.Open(args.InputFile)
+		if err := checkConvention(); err != nil {
+			panic(err)
+		}
+		if err := checkFormat(); err != nil {
+			panic(err)
+		}
+		if err := setupReservedKeys(); err != nil {
+			panic(err)
+		}
+		if err := checkMultipleRootsMode(); err != nil {
+			panic(err)
+		}
+		if err := checkEntitiesMode(); err != nil {
+			panic(err)
+		}
+		if err := checkC14NMode(); err != nil {
+			panic(err)
+		}
+		if err := checkCanonicalJSON(); err != nil {
+			panic(err)
+		}
+		if err := checkQuery(); err != nil {
+			panic(err)
+		}
+		if err := checkSplitAt(); err != nil {
+			panic(err)
+		}
+
+		// 引数の指定がない場合は標準入力から読み取る。
+		var input io.Reader = os.Stdin
+		if len(args.InputFile) != 0 || len(os.Args) != 1 {
+			file, err := os.Open(args.InputFile)
 			if err != nil {
 				panic(errors.Errorf("入力ファイルを開けません: %v", err))
 			}
-			defer input.Close()
-
+			defer file.Close()
+			input = file
+		}
+		// CSV, IDT 形式ではディレクトリにテーブルごとのファイルを書き出す。
+		if isTableDirectoryFormat() && !ToXML {
 			inputString, err = io.ReadAll(input)
 			if err != nil {
-				panic(errors.Errorf("入力ファイルの読み込みに失敗しました: %v", err))
+				panic(errors.Errorf("入力の読み込みに失敗しました: %v", err))
+			}
+			if currentFormat() == FormatIDT {
+				ConvertXMLToIDT(inputString, args.OutputFile)
+			} else {
+				ConvertXMLToCSV(inputString, args.OutputFile)
 			}
+			return
 		}
 		if args.OutputFile != "" {
 			file, err := os.Create(args.OutputFile)
@@ -102,9 +134,41 @@ func main() {
 		} else {
 			output = os.Stdout
 		}
+
+		// JSON Lines からXMLを組み立てる場合は、入力を全て読み込まずに1行ずつ処理する。
+		if ToXML && args.NDJSON {
+			ConvertNDJSONToXML(input, output)
+			return
+		}
+		// CSV, IDT 形式では -i に指定したディレクトリからXMLを組み立てる。
+		if ToXML && isTableDirectoryFormat() {
+			if currentFormat() == FormatIDT {
+				ConvertIDTToXML(args.InputFile, output)
+			} else {
+				ConvertCSVToXML(args.InputFile, output)
+			}
+			return
+		}
+
+		// レコード分割では、入力を全て読み込まずに1レコードずつ処理する。
+		if args.SplitAt != "" {
+			convertXMLToSplitRecords(input, output)
+			return
+		}
+
+		inputString, err = io.ReadAll(input)
+		if err != nil {
+			panic(errors.Errorf("入力の読み込みに失敗しました: %v", err))
+		}
 	}
 
-	if !ToXML {
+	if args.Query != nil {
+		QueryXML(inputString, output)
+	} else if currentFormat() == FormatSQL {
+		ConvertXMLToSQL(inputString, output)
+	} else if !ToXML && currentC14NMode() != "" {
+		ConvertXMLToC14N(inputString, output)
+	} else if !ToXML {
 		ConvertXMLToJSON(inputString, output)
 	} else {
 		ConvertJSONToXML(inputString, output)
@@ -116,16 +180,44 @@ func main() {
 // ---------------------------------------------------------------------
 
 func ConvertXMLToJSON(inputString []byte, output io.Writer) {
-	decoder := xml.NewDecoder(bytes.NewReader(inputString))
-	root := make(map[string]interface{})
-	orderMap := make(map[string][]string)
-	comments := []string{}
-	processingInstructions := []map[string]string{}
-	var doctype string
+	var jsonData []byte
+	var err error
+	if args.Fragment {
+		// トップレベルの要素ごとにレコードとして出力する。
+		records := parseXMLToRecords(inputString)
+		for i := range records {
+			if err := checkTableDocument(records[i]); err != nil {
+				panic(errors.Errorf("%d番目のレコード: %v", i+1, err))
+			}
+			records[i] = convertFromDefaultConvention(records[i])
+		}
+		jsonData, err = marshalJSONRecords(records)
+	} else {
+		root := parseXMLToMap(inputString)
+		if err := checkTableDocument(root); err != nil {
+			panic(err)
+		}
+		root = convertFromDefaultConvention(root)
+		jsonData, err = marshalDocument(root)
+	}
+	if err != nil {
+		panic(errors.Errorf("JSONへの変換に失敗しました: %v", err))
+	}
 
-	elementStack := []map[string]interface{}{}
-	nameStack := []string{}
-	currentElement := root
+	// 出力直前に改行コードをCRLFに統一する（バイナリ形式を除く）
+	if !isBinaryFormat() {
+		jsonData = []byte(normalizeNewlinesToCRLF(string(jsonData)))
+	}
+	_, err = output.Write(jsonData)
+	if err != nil {
+		panic(errors.Errorf("JSONデータの書き込みに失敗しました: %v", err))
+	}
+}
+
+// parseXMLToMap はXMLを読み込み、既定の形式（@/$ 形式）の内部表現を作成する。
+func parseXMLToMap(inputString []byte) map[string]interface{} {
+	decoder := newXMLTokenReader(inputString)
+	b := newXMLTreeBuilder()
 
 	for {
 		token, err := decoder.Token()
@@ -135,155 +227,219 @@ func ConvertXMLToJSON(inputString []byte, output io.Writer) {
 		if err != nil {
 			panic(errors.Errorf("XMLのパースに失敗しました: %v", err))
 		}
+		b.handleToken(token, decoder.Source())
+	}
 
-		switch t := token.(type) {
-		case xml.StartElement:
-			element := make(map[string]interface{})
-			// 属性の並び順を記録する。
-			var attrOrder []string
-			for _, attr := range t.Attr {
-				var attrName string
-				if attr.Name.Space != "" {
-					attrName = "@" + attr.Name.Space + ":" + attr.Name.Local
-				} else {
-					attrName = "@" + attr.Name.Local
-				}
-				attrOrder = append(attrOrder, attrName)
+	return b.result()
+}
 
-				if attr.Name.Space == "xmlns" {
-					if element["@xmlns"] == nil {
-						element["@xmlns"] = make(map[string]interface{})
-					}
-					namespaces := element["@xmlns"].(map[string]interface{})
-					if attr.Name.Local == "" {
-						namespaces["$"] = attr.Value
-					} else {
-						namespaces[attr.Name.Local] = attr.Value
-					}
-				} else {
-					element[attrName] = attr.Value
-				}
-			}
-			if len(attrOrder) > 0 {
-				// $attrOrder をそのまま保存する。
-				element["$attrOrder"] = attrOrder
-			}
+// xmlTreeBuilder はXMLのトークンを順に受け取り、既定の形式の内部表現を組み立てる。
+type xmlTreeBuilder struct {
+	root                   map[string]interface{}
+	orderMap               map[string][]string
+	comments               []string
+	processingInstructions []map[string]string
+	doctype                interface{} // 構造化した DOCTYPE、または解釈できない場合は文字列
+	nodeOrder              []string    // トップレベルのノードの並び（$nodeOrder）
+
+	elementStack     []map[string]interface{}
+	nameStack        []string
+	selfClosingStack []bool // 開始タグが空要素タグ（<a/>）だったか
+	currentElement   map[string]interface{}
+}
+
+func newXMLTreeBuilder() *xmlTreeBuilder {
+	root := make(map[string]interface{})
+	return &xmlTreeBuilder{
+		root:                   root,
+		orderMap:               make(map[string][]string),
+		comments:               []string{},
+		processingInstructions: []map[string]string{},
+		elementStack:           []map[string]interface{}{},
+		nameStack:              []string{},
+		currentElement:         root,
+	}
+}
+
+// depth は現在開いている要素の深さを返す。トップレベルでは 0。
+func (b *xmlTreeBuilder) depth() int {
+	return len(b.elementStack)
+}
 
-			elementName := t.Name.Local
-			if t.Name.Space != "" {
-				elementName = t.Name.Space + ":" + elementName
+// isEmpty は要素やコメントなどを何も受け取っていないかどうかを返す。
+func (b *xmlTreeBuilder) isEmpty() bool {
+	return len(b.root) == 0 && len(b.comments) == 0 && len(b.processingInstructions) == 0 && b.doctype == nil
+}
+
+// handleToken はトークンを1つ処理する。source はトークンの入力での書き方で、分からない場合は nil。
+func (b *xmlTreeBuilder) handleToken(token xml.Token, source []byte) {
+	switch t := token.(type) {
+	case xml.StartElement:
+		elementName, element := elementFromStartElement(t)
+		recordAttrSources(element, t, source)
+		b.recordNode(jsonPointer("", elementName))
+		b.nameStack = append(b.nameStack, elementName)
+		b.selfClosingStack = append(b.selfClosingStack, isSelfClosingTag(source))
+		if len(b.nameStack) > 1 {
+			parentPath := strings.Join(b.nameStack[:len(b.nameStack)-1], "/")
+			if _, exists := b.orderMap[parentPath]; !exists {
+				b.orderMap[parentPath] = []string{}
 			}
-			nameStack = append(nameStack, elementName)
-			if len(nameStack) > 1 {
-				parentPath := strings.Join(nameStack[:len(nameStack)-1], "/")
-				if _, exists := orderMap[parentPath]; !exists {
-					orderMap[parentPath] = []string{}
-				}
-				found := false
-				for _, name := range orderMap[parentPath] {
-					if name == elementName {
-						found = true
-						break
-					}
-				}
-				if !found {
-					orderMap[parentPath] = append(orderMap[parentPath], elementName)
+			found := false
+			for _, name := range b.orderMap[parentPath] {
+				if name == elementName {
+					found = true
+					break
 				}
 			}
+			if !found {
+				b.orderMap[parentPath] = append(b.orderMap[parentPath], elementName)
+			}
+		}
 
-			if existingElement, ok := currentElement[elementName]; ok {
-				if array, ok := existingElement.([]interface{}); ok {
-					currentElement[elementName] = append(array, element)
-				} else {
-					currentElement[elementName] = []interface{}{existingElement, element}
-				}
+		if existingElement, ok := b.currentElement[elementName]; ok {
+			if array, ok := existingElement.([]interface{}); ok {
+				b.currentElement[elementName] = append(array, element)
 			} else {
-				if alwaysArrayElements[elementName] {
-					currentElement[elementName] = []interface{}{element}
-				} else {
-					currentElement[elementName] = element
-				}
+				b.currentElement[elementName] = []interface{}{existingElement, element}
 			}
-
-			elementStack = append(elementStack, currentElement)
-			if array, ok := currentElement[elementName].([]interface{}); ok {
-				currentElement = array[len(array)-1].(map[string]interface{})
+		} else {
+			if alwaysArrayElements[elementName] {
+				b.currentElement[elementName] = []interface{}{element}
 			} else {
-				currentElement = currentElement[elementName].(map[string]interface{})
+				b.currentElement[elementName] = element
 			}
+		}
 
-		case xml.EndElement:
-			if len(elementStack) > 0 {
-				currentElement = elementStack[len(elementStack)-1]
-				elementStack = elementStack[:len(elementStack)-1]
-				if len(nameStack) > 0 {
-					nameStack = nameStack[:len(nameStack)-1]
+		b.elementStack = append(b.elementStack, b.currentElement)
+		if array, ok := b.currentElement[elementName].([]interface{}); ok {
+			b.currentElement = array[len(array)-1].(map[string]interface{})
+		} else {
+			b.currentElement = b.currentElement[elementName].(map[string]interface{})
+		}
+
+	case xml.EndElement:
+		if len(b.elementStack) > 0 {
+			// 入力での書き方が分かる場合のみ、空要素の書き方を記録する。
+			if depth := len(b.selfClosingStack); depth > 0 {
+				if source != nil {
+					recordEmptyElement(b.currentElement, b.nameStack, b.selfClosingStack[depth-1])
 				}
+				b.selfClosingStack = b.selfClosingStack[:depth-1]
 			}
-
-		case xml.CharData:
-			text := string(t)
-			if strings.TrimSpace(text) != "" {
-				currentElement["$"] = text
+			b.currentElement = b.elementStack[len(b.elementStack)-1]
+			b.elementStack = b.elementStack[:len(b.elementStack)-1]
+			if len(b.nameStack) > 0 {
+				b.nameStack = b.nameStack[:len(b.nameStack)-1]
 			}
+		}
 
-		case xml.Comment:
-			commentText := string(t)
-			comments = append(comments, commentText)
-			if len(elementStack) == 0 {
-				root["$comment"] = comments
+	case xml.CharData:
+		text := string(t)
+		if strings.TrimSpace(text) != "" {
+			value := textWithEntityNodes(text)
+			b.currentElement[keys.Text] = value
+			if segments, ok := value.([]interface{}); ok {
+				// 実体参照のノードを含むテキストは、ノードの間の文字列ごとに書き方を保存する。
+				recordSegmentSources(b.currentElement, segments, source)
+			} else {
+				recordTextSource(b.currentElement, text, source)
 			}
+		}
 
-		case xml.ProcInst:
-			pi := map[string]string{
-				"target": t.Target,
-				"data":   string(t.Inst),
-			}
-			processingInstructions = append(processingInstructions, pi)
-			if len(elementStack) == 0 {
-				root["$pi"] = processingInstructions
-			}
+	case xml.Comment:
+		commentText := string(t)
+		b.comments = append(b.comments, commentText)
+		b.recordNode(fmt.Sprintf("%s/%d", jsonPointer("", keys.Comment()), len(b.comments)-1))
+		if len(b.elementStack) == 0 {
+			b.root[keys.Comment()] = b.comments
+		}
 
-		case xml.Directive:
-			directiveText := string(t)
-			if strings.HasPrefix(strings.TrimSpace(directiveText), "DOCTYPE") {
-				doctype = "<!" + string(t) + ">"
-				if len(elementStack) == 0 {
-					root["$doctype"] = doctype
-				}
-			}
+	case xml.ProcInst:
+		pi := map[string]string{
+			"target": t.Target,
+			"data":   string(t.Inst),
+		}
+		b.processingInstructions = append(b.processingInstructions, pi)
+		b.recordNode(fmt.Sprintf("%s/%d", jsonPointer("", keys.PI()), len(b.processingInstructions)-1))
+		if len(b.elementStack) == 0 {
+			b.root[keys.PI()] = b.processingInstructions
 		}
-	}
 
-	if len(comments) > 0 && root["$comment"] == nil {
-		root["$comment"] = comments
+	case xml.Directive:
+		// DOCTYPE 以外の宣言は xmlTokenReader がエラーにする。
+		// 構造として解釈できない DOCTYPE は、情報を失わないよう以前の形式の文字列で保存する。
+		if doctype, err := parseDoctype(string(t)); err == nil {
+			b.doctype = doctype
+		} else {
+			b.doctype = "<!" + string(t) + ">"
+		}
+		if len(b.elementStack) == 0 {
+			b.root[keys.Doctype()] = b.doctype
+		}
+		b.recordNode(jsonPointer("", keys.Doctype()))
 	}
-	if len(processingInstructions) > 0 && root["$pi"] == nil {
-		root["$pi"] = processingInstructions
+}
+
+// elementFromStartElement は開始タグから要素のJSONのキーと、属性を格納した要素の内部表現を作成する。
+func elementFromStartElement(t xml.StartElement) (string, map[string]interface{}) {
+	element := make(map[string]interface{})
+	// 属性の並び順を記録する。
+	var attrOrder []string
+	for _, attr := range t.Attr {
+		var attrName string
+		if attr.Name.Space != "" {
+			attrName = keys.Attr(attr.Name.Space + ":" + decodeXMLName(attr.Name.Local))
+		} else {
+			attrName = keys.Attr(decodeXMLName(attr.Name.Local))
+		}
+		attrOrder = append(attrOrder, attrName)
+
+		if attr.Name.Space == "xmlns" {
+			switch ns := element[keys.Xmlns()].(type) {
+			case nil:
+				element[keys.Xmlns()] = make(map[string]interface{})
+			case string:
+				// 既定の名前空間宣言と同時に宣言された場合は、既定の名前空間をテキストキーにしてまとめる。
+				element[keys.Xmlns()] = map[string]interface{}{keys.Text: ns}
+			}
+			namespaces := element[keys.Xmlns()].(map[string]interface{})
+			namespaces[attr.Name.Local] = attr.Value
+		} else if namespaces, ok := element[attrName].(map[string]interface{}); ok {
+			// 接頭辞付きの名前空間宣言の後に既定の名前空間宣言 xmlns="..." がある場合。
+			namespaces[keys.Text] = attr.Value
+		} else {
+			element[attrName] = attr.Value
+		}
 	}
-	if doctype != "" && root["$doctype"] == nil {
-		root["$doctype"] = doctype
+	if len(attrOrder) > 0 {
+		// $attrOrder をそのまま保存する。
+		element[keys.AttrOrder()] = attrOrder
 	}
 
-	root["$orderMap"] = orderMap
+	// 予約キーと衝突する要素名はエスケープする。
+	return jsonKeyFromXMLName(t.Name.Space, t.Name.Local), element
+}
 
-	var jsonData []byte
-	var err error
-	if args.Minify {
-		jsonData, err = json.Marshal(root)
-	} else {
-		jsonData, err = json.MarshalIndent(root, "", "\t")
+// result は組み立てた内部表現にメタデータを加えて返す。
+func (b *xmlTreeBuilder) result() map[string]interface{} {
+	root := b.root
+	if len(b.comments) > 0 && root[keys.Comment()] == nil {
+		root[keys.Comment()] = b.comments
 	}
-	if err != nil {
-		panic(errors.Errorf("JSONへの変換に失敗しました: %v", err))
+	if len(b.processingInstructions) > 0 && root[keys.PI()] == nil {
+		root[keys.PI()] = b.processingInstructions
+	}
+	if b.doctype != nil && root[keys.Doctype()] == nil {
+		root[keys.Doctype()] = b.doctype
 	}
 
-	// 出力直前に改行コードをCRLFに統一する
-	normalized := normalizeNewlinesToCRLF(string(jsonData))
-	_, err = output.Write([]byte(normalized))
-	if err != nil {
-		panic(errors.Errorf("JSONデータの書き込みに失敗しました: %v", err))
+	root[keys.OrderMap()] = b.orderMap
+	if !isDefaultNodeOrder(b.nodeOrder) {
+		root[keys.NodeOrder()] = b.nodeOrder
 	}
+
+	return root
 }
 
 // ---------------------------------------------------------------------
@@ -291,14 +447,69 @@ func ConvertXMLToJSON(inputString []byte, output io.Writer) {
 // ---------------------------------------------------------------------
 
 func ConvertJSONToXML(inputString []byte, output io.Writer) {
-	var root map[string]interface{}
-	err := json.Unmarshal(inputString, &root)
+	var buffer bytes.Buffer
+	if args.Fragment {
+		// 各レコードをXMLフラグメントとして順に出力する。
+		records, err := parseJSONRecords(inputString)
+		if err != nil {
+			panic(errors.Errorf("JSONのパースに失敗しました: %v", err))
+		}
+		for i, record := range records {
+			if err := writeXMLDocument(&buffer, record, true); err != nil {
+				panic(errors.Errorf("%d番目のレコード: %v", i+1, err))
+			}
+		}
+	} else {
+		root, err := unmarshalDocumentObject(inputString)
+		if err != nil {
+			panic(errors.Errorf("JSONのパースに失敗しました: %v", err))
+		}
+		if err := writeXMLDocument(&buffer, root, false); err != nil {
+			panic(err)
+		}
+	}
+
+	// 正規化したXMLは整形せず、改行コードもそのまま出力する。
+	if currentC14NMode() != "" {
+		ConvertXMLToC14N(buffer.Bytes(), output)
+		return
+	}
+
+	result := buffer.Bytes()
+	if !args.Minify {
+		result = []byte(strings.TrimLeft(formatXML(string(result), "", "\t"), "\r\n"))
+	}
+
+	// 出力直前に改行コードをCRLFに統一する
+	normalized := normalizeNewlinesToCRLF(string(result))
+	_, err := output.Write([]byte(normalized))
 	if err != nil {
-		panic(errors.Errorf("JSONのパースに失敗しました: %v", err))
+		panic(errors.Errorf("XMLデータの書き込みに失敗しました: %v", err))
+	}
+}
+
+// writeXMLDocument は1つの文書（またはフラグメントのレコード）の内部表現をXMLとして buffer に書き出す。
+// fragment が true の場合、ルート要素がなくても、複数あってもよい。
+func writeXMLDocument(buffer *bytes.Buffer, root map[string]interface{}, fragment bool) error {
+	root = convertToDefaultConvention(root)
+	if args.TableRows {
+		if err := tableObjectsToRows(root); err != nil {
+			return err
+		}
+	}
+
+	// 既定の形式の場合、XMLを書き出す前に構造を検証する。
+	if currentConvention() == ConventionDefault && !args.Lenient {
+		if violations := validateJSONDocument(root, !fragment); len(violations) > 0 {
+			return errors.Errorf("JSONの構造が不正です（%d件）:\n%s", len(violations), strings.Join(violations, "\n"))
+		}
+	}
+	if err := checkTableDocument(root); err != nil {
+		return err
 	}
 
 	var orderMap map[string][]string
-	if orderData, ok := root["$orderMap"]; ok {
+	if orderData, ok := root[keys.OrderMap()]; ok {
 		orderMap = make(map[string][]string)
 		if orderMapData, ok := orderData.(map[string]interface{}); ok {
 			for path, value := range orderMapData {
@@ -312,95 +523,56 @@ func ConvertJSONToXML(inputString []byte, output io.Writer) {
 				}
 			}
 		}
-		delete(root, "$orderMap")
-	}
-
-	var buffer bytes.Buffer
-	declarations := make(map[string]string)
-	processingInstructions := []map[string]string{}
-	var doctype string
-	var comments []string
-
-	if piValue, ok := root["$pi"]; ok {
-		if piArray, ok := piValue.([]interface{}); ok {
-			for _, piItem := range piArray {
-				if pi, ok := piItem.(map[string]interface{}); ok {
-					target, _ := pi["target"].(string)
-					data, _ := pi["data"].(string)
-					if target == "xml" {
-						declarations["xml"] = data
-					} else {
-						processingInstructions = append(processingInstructions, map[string]string{
-							"target": target,
-							"data":   data,
-						})
-					}
-				}
-			}
-		}
-		delete(root, "$pi")
-	}
-
-	if doctypeValue, ok := root["$doctype"]; ok {
-		if doctypeStr, ok := doctypeValue.(string); ok {
-			doctype = doctypeStr
-		}
-		delete(root, "$doctype")
-	}
-
-	if commentValue, ok := root["$comment"]; ok {
-		if commentArray, ok := commentValue.([]interface{}); ok {
-			for _, commentItem := range commentArray {
-				if comment, ok := commentItem.(string); ok {
-					comments = append(comments, comment)
-				}
-			}
-		}
-		delete(root, "$comment")
-	}
-
-	if xmlDecl, ok := declarations["xml"]; ok {
-		buffer.WriteString("<?xml " + xmlDecl + "?>\n")
-	} else {
-		buffer.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+		delete(root, keys.OrderMap())
 	}
 
-	for _, pi := range processingInstructions {
-		buffer.WriteString("<?")
-		buffer.WriteString(pi["target"])
-		buffer.WriteString(" ")
-		buffer.WriteString(pi["data"])
-		buffer.WriteString("?>\n")
+	// ルート要素が複数ある場合の扱いを決める。
+	rootNames := topLevelElementNames(root, orderMap)
+	rootMode := multipleRootsMode()
+	if fragment {
+		rootMode = MultipleRootsFragment
+	} else if countTopLevelElements(root, rootNames) <= 1 {
+		rootMode = MultipleRootsError
+	} else if rootMode == MultipleRootsError {
+		return errors.Errorf("ルート要素が複数あります: %s\n--multiple-roots fragment または --multiple-roots wrap を指定してください", strings.Join(rootNames, ", "))
 	}
 
-	if doctype != "" {
-		buffer.WriteString(doctype + "\n")
-	}
+	// $source の書き方を検証するため、DOCTYPE で宣言された実体を読み取っておく。
+	sourceEntities = doctypeEntities(root)
 
-	for _, comment := range comments {
-		buffer.WriteString("<!--")
-		buffer.WriteString(comment)
-		buffer.WriteString("-->\n")
-	}
+	// フラグメントとして出力する場合、XML宣言は明示されたときのみ出力する。
+	// $nodeOrder があれば、XML宣言、処理命令、DOCTYPE、コメントとルート要素をその順に出力する。
+	prolog := collectPrologNodes(root, rootMode != MultipleRootsFragment)
+	order := takeNodeOrder(root)
 
 	// 初期の名前空間コンテキストは空で開始
-	for elementName, elementValue := range root {
-		if strings.HasPrefix(elementName, "$") {
-			continue
-		}
-		writeXMLElement(&buffer, elementName, elementValue, 0, orderMap, make(map[string]string))
-	}
-
-	result := buffer.Bytes()
-	if !args.Minify {
-		result = []byte(strings.TrimLeft(xmlfmt.FormatXML(string(result), "", "\t"), "\r\n"))
+	if rootMode == MultipleRootsWrap {
+		wrapped := false
+		writeTopLevelNodes(buffer, prolog, order, rootNames, func(string) {
+			// 包含要素は最初のルート要素の位置に1つだけ出力する。
+			if wrapped {
+				return
+			}
+			wrapped = true
+			wrapper := make(map[string]interface{})
+			for _, elementName := range rootNames {
+				wrapper[elementName] = root[elementName]
+			}
+			writeXMLElement(buffer, keys.EscapeName(args.Wrapper), wrapper, 0, orderMap, make(map[string]string))
+		})
+	} else {
+		writeTopLevelNodes(buffer, prolog, order, rootNames, func(elementName string) {
+			writeXMLElement(buffer, elementName, root[elementName], 0, orderMap, make(map[string]string))
+		})
 	}
+	return nil
+}
 
-	// 出力直前に改行コードをCRLFに統一する
-	normalized := normalizeNewlinesToCRLF(string(result))
-	_, err = output.Write([]byte(normalized))
-	if err != nil {
-		panic(errors.Errorf("XMLデータの書き込みに失敗しました: %v", err))
+// writeXMLProlog は $pi, $doctype, $comment をXML宣言、処理命令、DOCTYPE、コメントとして書き出し、root から取り除く。
+// XML宣言が $pi にない場合、defaultDeclaration が true なら既定のXML宣言を出力する。
+func writeXMLProlog(buffer *bytes.Buffer, root map[string]interface{}, defaultDeclaration bool) {
+	for _, node := range collectPrologNodes(root, defaultDeclaration) {
+		buffer.WriteString(node.markup)
 	}
 }
 
@@ -414,27 +586,40 @@ func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}, inden
 		return
 	}
 
-	buffer.WriteString("<")
-	buffer.WriteString(name)
-
 	// 名前空間コンテキストのローカルコピーを作成。
 	localNS := make(map[string]string)
 	for k, v := range nsContext {
 		localNS[k] = v
 	}
 
+	// 要素自身の xmlns 宣言を先に反映してから、要素名の名前空間URIをプレフィックスに戻す。
+	if element, ok := value.(map[string]interface{}); ok {
+		switch ns := element[keys.Xmlns()].(type) {
+		case map[string]interface{}:
+			for prefix, uri := range ns {
+				localNS[prefix] = fmt.Sprintf("%v", uri)
+			}
+		case string:
+			localNS[keys.Text] = ns
+		}
+	}
+	xmlName := resolvePrefixedName(xmlNameFromJSONKey(name), localNS)
+
+	buffer.WriteString("<")
+	buffer.WriteString(xmlName)
+
 	// 属性を、$attrOrder があればその順序で出力する。
 	if element, ok := value.(map[string]interface{}); ok {
 		var rawAttrKeys []string
 		attrMap := make(map[string]interface{})
 		for k, v := range element {
-			if strings.HasPrefix(k, "@") {
+			if keys.IsAttr(k) {
 				rawAttrKeys = append(rawAttrKeys, k)
 				attrMap[k] = v
 			}
 		}
 		var outputAttrKeys []string
-		if orderVal, ok := element["$attrOrder"]; ok {
+		if orderVal, ok := element[keys.AttrOrder()]; ok {
 			var orderSlice []string
 			if arr, ok := orderVal.([]interface{}); ok {
 				for _, v := range arr {
@@ -464,7 +649,7 @@ func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}, inden
 					outputAttrKeys = append(outputAttrKeys, key)
 				}
 			}
-			delete(element, "$attrOrder")
+			delete(element, keys.AttrOrder())
 		} else {
 			outputAttrKeys = rawAttrKeys
 			sort.Strings(outputAttrKeys)
@@ -474,15 +659,23 @@ func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}, inden
 		var xmlnsAttrs []string
 		for _, attrKey := range outputAttrKeys {
 			v := attrMap[attrKey]
-			if attrKey == "@xmlns" {
+			if attrKey == keys.Xmlns() {
 				if nsMap, ok := v.(map[string]interface{}); ok {
 					for prefix, uri := range nsMap {
-						xmlnsAttrs = append(xmlnsAttrs, fmt.Sprintf(" xmlns:%s=\"%s\"", prefix, uri))
+						if prefix == keys.Text {
+							// 既定の名前空間。
+							xmlnsAttrs = append(xmlnsAttrs, fmt.Sprintf(" xmlns=\"%s\"", uri))
+						} else {
+							xmlnsAttrs = append(xmlnsAttrs, fmt.Sprintf(" xmlns:%s=\"%s\"", prefix, uri))
+						}
 						localNS[prefix] = fmt.Sprintf("%s", uri)
 					}
+				} else if uri, ok := v.(string); ok {
+					xmlnsAttrs = append(xmlnsAttrs, fmt.Sprintf(" xmlns=\"%s\"", uri))
+					localNS[keys.Text] = uri
 				}
 			} else {
-				rawName := attrKey[1:]
+				rawName := attrNameFromJSONKey(attrKey)
 				// 名前空間付き属性の場合、ローカルコンテキストからプレフィックスを再設定。
 				if idx := strings.LastIndex(rawName, ":"); idx != -1 {
 					nsURI := rawName[:idx]
@@ -494,15 +687,18 @@ func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}, inden
 							break
 						}
 					}
+					// xml 接頭辞は宣言なしで使える。
+					if nsURI == xmlNamespaceURI {
+						prefix = "xml"
+					}
 					if prefix != "" {
 						rawName = prefix + ":" + localName
 					}
 				}
 				buffer.WriteString(" ")
 				buffer.WriteString(rawName)
-				buffer.WriteString("=\"")
-				buffer.WriteString(escapeXMLAttr(fmt.Sprintf("%v", v)))
-				buffer.WriteString("\"")
+				buffer.WriteString("=")
+				buffer.WriteString(xmlAttrOutput(element, attrKey, v))
 			}
 		}
 		// 出力する xmlns 宣言。
@@ -513,27 +709,33 @@ func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}, inden
 		// 子要素と内容の有無をチェック。
 		hasContent := false
 		for key := range element {
-			if !strings.HasPrefix(key, "@") {
+			if !keys.IsAttr(key) && !isSourceMeta(key) {
 				hasContent = true
 				break
 			}
 		}
 		if !hasContent {
-			buffer.WriteString("/>")
+			if emptyElementForm(element, EmptyElementSelf) == EmptyElementPair {
+				buffer.WriteString("></" + xmlName + ">")
+			} else {
+				buffer.WriteString("/>")
+			}
 			return
 		}
 		buffer.WriteString(">")
 
-		// テキスト内容の処理。
-		if textValue, ok := element["$"]; ok {
-			buffer.WriteString(preserveXMLEntities(fmt.Sprintf("%v", textValue)))
+		// テキスト内容の処理。実体参照のノードを含む場合は文字列とノードの配列になる。
+		if segments, ok := element[keys.Text].([]interface{}); ok {
+			writeTextSegments(buffer, element, segments)
+		} else if textValue, ok := element[keys.Text]; ok {
+			buffer.WriteString(xmlTextOutput(element, textValue))
 		}
-		if cdataValue, ok := element["$cdata"]; ok {
+		if cdataValue, ok := element[keys.CDATA()]; ok {
 			buffer.WriteString("<![CDATA[")
 			buffer.WriteString(fmt.Sprintf("%v", cdataValue))
 			buffer.WriteString("]]>")
 		}
-		if rawValue, ok := element["$raw"]; ok {
+		if rawValue, ok := element[keys.Raw()]; ok {
 			buffer.WriteString(fmt.Sprintf("%v", rawValue))
 		}
 
@@ -548,13 +750,13 @@ func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}, inden
 							var colRawAttrKeys []string
 							colAttrMap := make(map[string]interface{})
 							for k, v := range colMap {
-								if strings.HasPrefix(k, "@") {
+								if keys.IsAttr(k) {
 									colRawAttrKeys = append(colRawAttrKeys, k)
 									colAttrMap[k] = v
 								}
 							}
 							var colOutputAttrKeys []string
-							if orderVal, ok := colMap["$attrOrder"]; ok {
+							if orderVal, ok := colMap[keys.AttrOrder()]; ok {
 								var orderSlice []string
 								if arr, ok := orderVal.([]interface{}); ok {
 									for _, v := range arr {
@@ -582,24 +784,25 @@ func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}, inden
 										colOutputAttrKeys = append(colOutputAttrKeys, key)
 									}
 								}
-								delete(colMap, "$attrOrder")
+								delete(colMap, keys.AttrOrder())
 							} else {
 								colOutputAttrKeys = colRawAttrKeys
 								sort.Strings(colOutputAttrKeys)
 							}
 							for _, attrKey := range colOutputAttrKeys {
 								v := colAttrMap[attrKey]
-								rawName := attrKey[1:]
+								rawName := attrNameFromJSONKey(attrKey)
 								buffer.WriteString(" ")
 								buffer.WriteString(rawName)
-								buffer.WriteString("=\"")
-								buffer.WriteString(escapeXMLAttr(fmt.Sprintf("%v", v)))
-								buffer.WriteString("\"")
+								buffer.WriteString("=")
+								buffer.WriteString(xmlAttrOutput(colMap, attrKey, v))
 							}
-							if textContent, ok := colMap["$"]; ok {
+							if textContent, ok := colMap[keys.Text]; ok {
 								buffer.WriteString(">")
-								buffer.WriteString(preserveXMLEntities(fmt.Sprintf("%v", textContent)))
+								buffer.WriteString(xmlTextOutput(colMap, textContent))
 								buffer.WriteString("</col>")
+							} else if emptyElementForm(colMap, EmptyElementSelf) == EmptyElementPair {
+								buffer.WriteString("></col>")
 							} else {
 								buffer.WriteString("/>")
 							}
@@ -621,13 +824,13 @@ func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}, inden
 											var tdRawAttrKeys []string
 											tdAttrMap := make(map[string]interface{})
 											for k, v := range tdMap {
-												if strings.HasPrefix(k, "@") {
+												if keys.IsAttr(k) {
 													tdRawAttrKeys = append(tdRawAttrKeys, k)
 													tdAttrMap[k] = v
 												}
 											}
 											var tdOutputAttrKeys []string
-											if orderVal, ok := tdMap["$attrOrder"]; ok {
+											if orderVal, ok := tdMap[keys.AttrOrder()]; ok {
 												var orderSlice []string
 												if arr, ok := orderVal.([]interface{}); ok {
 													for _, v := range arr {
@@ -655,14 +858,14 @@ func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}, inden
 														tdOutputAttrKeys = append(tdOutputAttrKeys, key)
 													}
 												}
-												delete(tdMap, "$attrOrder")
+												delete(tdMap, keys.AttrOrder())
 											} else {
 												tdOutputAttrKeys = tdRawAttrKeys
 												sort.Strings(tdOutputAttrKeys)
 											}
 											for _, attrKey := range tdOutputAttrKeys {
 												v := tdAttrMap[attrKey]
-												rawName := attrKey[1:]
+												rawName := attrNameFromJSONKey(attrKey)
 												if idx := strings.LastIndex(rawName, ":"); idx != -1 {
 													nsURI := rawName[:idx]
 													localName := rawName[idx+1:]
@@ -679,15 +882,16 @@ func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}, inden
 												}
 												buffer.WriteString(" ")
 												buffer.WriteString(rawName)
-												buffer.WriteString("=\"")
-												buffer.WriteString(escapeXMLAttr(fmt.Sprintf("%v", v)))
-												buffer.WriteString("\"")
+												buffer.WriteString("=")
+												buffer.WriteString(xmlAttrOutput(tdMap, attrKey, v))
 											}
-											buffer.WriteString(">")
-											if textContent, ok := tdMap["$"]; ok {
-												buffer.WriteString(preserveXMLEntities(fmt.Sprintf("%v", textContent)))
+											if textContent, ok := tdMap[keys.Text]; ok {
+												buffer.WriteString(">" + xmlTextOutput(tdMap, textContent) + "</td>")
+											} else if emptyElementForm(tdMap, EmptyElementPair) == EmptyElementSelf {
+												buffer.WriteString("/>")
+											} else {
+												buffer.WriteString("></td>")
 											}
-											buffer.WriteString("</td>")
 										}
 									}
 								} else if tdMap, ok := tdValue.(map[string]interface{}); ok {
@@ -695,13 +899,13 @@ func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}, inden
 									var tdRawAttrKeys []string
 									tdAttrMap := make(map[string]interface{})
 									for k, v := range tdMap {
-										if strings.HasPrefix(k, "@") {
+										if keys.IsAttr(k) {
 											tdRawAttrKeys = append(tdRawAttrKeys, k)
 											tdAttrMap[k] = v
 										}
 									}
 									var tdOutputAttrKeys []string
-									if orderVal, ok := tdMap["$attrOrder"]; ok {
+									if orderVal, ok := tdMap[keys.AttrOrder()]; ok {
 										var orderSlice []string
 										if arr, ok := orderVal.([]interface{}); ok {
 											for _, v := range arr {
@@ -729,14 +933,14 @@ func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}, inden
 												tdOutputAttrKeys = append(tdOutputAttrKeys, key)
 											}
 										}
-										delete(tdMap, "$attrOrder")
+										delete(tdMap, keys.AttrOrder())
 									} else {
 										tdOutputAttrKeys = tdRawAttrKeys
 										sort.Strings(tdOutputAttrKeys)
 									}
 									for _, attrKey := range tdOutputAttrKeys {
 										v := tdAttrMap[attrKey]
-										rawName := attrKey[1:]
+										rawName := attrNameFromJSONKey(attrKey)
 										if idx := strings.LastIndex(rawName, ":"); idx != -1 {
 											nsURI := rawName[:idx]
 											localName := rawName[idx+1:]
@@ -753,15 +957,16 @@ func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}, inden
 										}
 										buffer.WriteString(" ")
 										buffer.WriteString(rawName)
-										buffer.WriteString("=\"")
-										buffer.WriteString(escapeXMLAttr(fmt.Sprintf("%v", v)))
-										buffer.WriteString("\"")
+										buffer.WriteString("=")
+										buffer.WriteString(xmlAttrOutput(tdMap, attrKey, v))
 									}
-									buffer.WriteString(">")
-									if textContent, ok := tdMap["$"]; ok {
-										buffer.WriteString(preserveXMLEntities(fmt.Sprintf("%v", textContent)))
+									if textContent, ok := tdMap[keys.Text]; ok {
+										buffer.WriteString(">" + xmlTextOutput(tdMap, textContent) + "</td>")
+									} else if emptyElementForm(tdMap, EmptyElementPair) == EmptyElementSelf {
+										buffer.WriteString("/>")
+									} else {
+										buffer.WriteString("></td>")
 									}
-									buffer.WriteString("</td>")
 								}
 							}
 						}
@@ -772,7 +977,7 @@ func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}, inden
 		} else {
 			var childKeys []string
 			for key := range element {
-				if !strings.HasPrefix(key, "@") && !strings.HasPrefix(key, "$") && key != "col" && key != "row" {
+				if keys.IsElement(key) && key != "col" && key != "row" {
 					childKeys = append(childKeys, key)
 				}
 			}
@@ -813,15 +1018,15 @@ func writeXMLElement(buffer *bytes.Buffer, name string, value interface{}, inden
 		}
 
 		buffer.WriteString("</")
-		buffer.WriteString(name)
+		buffer.WriteString(xmlName)
 		buffer.WriteString(">")
 	} else {
 		buffer.WriteString(">")
 		if value != nil {
-			buffer.WriteString(preserveXMLEntities(fmt.Sprintf("%v", value)))
+			buffer.WriteString(escapeXMLText(fmt.Sprintf("%v", value)))
 		}
 		buffer.WriteString("</")
-		buffer.WriteString(name)
+		buffer.WriteString(xmlName)
 		buffer.WriteString(">")
 	}
 }
@@ -842,22 +1047,48 @@ func escapeXMLText(s string) string {
 	return s
 }
 
-func preserveXMLEntities(s string) string {
-	entityPattern := regexp.MustCompile(`&(amp|lt|gt|quot|apos|#\d+);`)
-	placeholderStr := "PLACEHOLDER_"
-	count := 0
-	placeholders := make(map[string]string)
-	result := entityPattern.ReplaceAllStringFunc(s, func(entity string) string {
-		key := fmt.Sprintf("%s%d", placeholderStr, count)
-		placeholders[key] = entity
-		count++
-		return key
-	})
-	result = escapeXMLText(result)
-	for key, entity := range placeholders {
-		result = strings.Replace(result, key, entity, 1)
-	}
-	return result
+// formatXML は xmlfmt でXMLを整形する。xmlfmt は DOCTYPE の内部サブセットの宣言や処理命令を開始タグとして扱い、
+// 字下げが崩れるため、ルート要素の外にあるノードはそのまま1行ずつ書き出し、ルート要素ごとに整形する。
+// 読み込めないXMLは全体をそのまま xmlfmt で整形する。
+func formatXML(s, prefix, indent string) string {
+	decoder := xml.NewDecoder(strings.NewReader(s))
+	decoder.Strict = false
+	var b strings.Builder
+	b.WriteString(prefix)
+	depth := 0
+	var elementStart int64
+	for {
+		start := decoder.InputOffset()
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return xmlfmt.FormatXML(s, prefix, indent)
+		}
+		end := decoder.InputOffset()
+		switch token.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				elementStart = start
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth == 0 {
+				// xmlfmt は先頭に prefix を付けるため、全体の先頭にだけ付ける。
+				b.WriteString(strings.TrimPrefix(xmlfmt.FormatXML(s[elementStart:end], prefix, indent), prefix))
+			}
+		default:
+			if node := strings.TrimSpace(s[start:end]); depth == 0 && node != "" {
+				b.WriteString(xmlfmt.NL + prefix + node)
+			}
+		}
+	}
+	if depth != 0 {
+		return xmlfmt.FormatXML(s, prefix, indent)
+	}
+	return b.String()
 }
 
 // 改行コードをCRLFに統一する関数
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ---------------------------------------------------------------------
+// 文書のトップレベルのノードの順序（$nodeOrder）
+// ---------------------------------------------------------------------
+
+// $nodeOrder はルート要素の前後にある処理命令、DOCTYPE、コメントとルート要素の入力での並びを、
+// JSON Pointer（"/$pi/0", "/$doctype", "/$comment/1", "/doc"）の配列で記録する。
+// 既定の順序（XML宣言、処理命令、DOCTYPE、コメント、ルート要素）と同じ並びの場合は記録しない。
+
+// xmlTopLevelNode はルート要素の外に書き出すノード。
+type xmlTopLevelNode struct {
+	pointer     string // $nodeOrder で参照する JSON Pointer（既定のXML宣言は空）
+	markup      string
+	declaration bool // XML宣言かどうか
+}
+
+// recordNode はトップレベルのノードの並びを記録する。
+func (b *xmlTreeBuilder) recordNode(pointer string) {
+	if b.depth() == 0 {
+		b.nodeOrder = append(b.nodeOrder, pointer)
+	}
+}
+
+// nodeOrderRank はノードの既定の順序での位置（処理命令、DOCTYPE、コメント、要素の順）を返す。
+func nodeOrderRank(pointer string) int {
+	switch {
+	case strings.HasPrefix(pointer, jsonPointer("", keys.PI())+"/"):
+		return 0
+	case pointer == jsonPointer("", keys.Doctype()):
+		return 1
+	case strings.HasPrefix(pointer, jsonPointer("", keys.Comment())+"/"):
+		return 2
+	}
+	return 3
+}
+
+// isDefaultNodeOrder は並びが既定の順序どおりかどうかを返す。
+func isDefaultNodeOrder(order []string) bool {
+	for i := 1; i < len(order); i++ {
+		if nodeOrderRank(order[i-1]) > nodeOrderRank(order[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// collectPrologNodes は $pi, $doctype, $comment から、XML宣言、処理命令、DOCTYPE、コメントのノードを既定の順序で作り、root から取り除く。
+// XML宣言が $pi にない場合、defaultDeclaration が true なら既定のXML宣言を先頭に加える。
+func collectPrologNodes(root map[string]interface{}, defaultDeclaration bool) []xmlTopLevelNode {
+	var declaration []xmlTopLevelNode
+	var processingInstructions, doctype, comments []xmlTopLevelNode
+
+	if piValue, ok := root[keys.PI()]; ok {
+		if piArray, ok := piValue.([]interface{}); ok {
+			for i, piItem := range piArray {
+				if pi, ok := piItem.(map[string]interface{}); ok {
+					target, _ := pi["target"].(string)
+					data, _ := pi["data"].(string)
+					pointer := fmt.Sprintf("%s/%d", jsonPointer("", keys.PI()), i)
+					if target == "xml" {
+						declaration = []xmlTopLevelNode{{pointer: pointer, markup: "<?xml " + data + "?>\n", declaration: true}}
+					} else {
+						processingInstructions = append(processingInstructions, xmlTopLevelNode{pointer: pointer, markup: "<?" + target + " " + data + "?>\n"})
+					}
+				}
+			}
+		}
+		delete(root, keys.PI())
+	}
+
+	if doctypeValue, ok := root[keys.Doctype()]; ok {
+		if markup := doctypeString(doctypeValue); markup != "" {
+			doctype = append(doctype, xmlTopLevelNode{pointer: jsonPointer("", keys.Doctype()), markup: markup + "\n"})
+		}
+		delete(root, keys.Doctype())
+	}
+
+	if commentValue, ok := root[keys.Comment()]; ok {
+		if commentArray, ok := commentValue.([]interface{}); ok {
+			for i, commentItem := range commentArray {
+				if comment, ok := commentItem.(string); ok {
+					pointer := fmt.Sprintf("%s/%d", jsonPointer("", keys.Comment()), i)
+					comments = append(comments, xmlTopLevelNode{pointer: pointer, markup: "<!--" + comment + "-->\n"})
+				}
+			}
+		}
+		delete(root, keys.Comment())
+	}
+
+	if declaration == nil && defaultDeclaration {
+		declaration = []xmlTopLevelNode{{markup: "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n", declaration: true}}
+	}
+
+	nodes := append(declaration, processingInstructions...)
+	nodes = append(nodes, doctype...)
+	return append(nodes, comments...)
+}
+
+// takeNodeOrder は $nodeOrder を取り出し、root から取り除く。
+func takeNodeOrder(root map[string]interface{}) []string {
+	var order []string
+	switch v := root[keys.NodeOrder()].(type) {
+	case []interface{}:
+		for _, item := range v {
+			if pointer, ok := item.(string); ok {
+				order = append(order, pointer)
+			}
+		}
+	case []string:
+		order = v
+	}
+	delete(root, keys.NodeOrder())
+	return order
+}
+
+// writeTopLevelNodes はXML宣言を先頭に、ほかのノードとルート要素を order の順に書き出す。
+// order にないノードは最初のルート要素の前に既定の順序で、order にないルート要素は最後に書き出す。
+func writeTopLevelNodes(buffer *bytes.Buffer, prolog []xmlTopLevelNode, order []string, rootNames []string, writeRoot func(name string)) {
+	referenced := make(map[string]bool)
+	for _, pointer := range order {
+		referenced[pointer] = true
+	}
+	rootPointers := make(map[string]string)
+	for _, name := range rootNames {
+		rootPointers[jsonPointer("", name)] = name
+	}
+
+	written := make(map[string]bool)
+	afterRoot := false
+	writeNode := func(node xmlTopLevelNode) {
+		if afterRoot {
+			// ルート要素の後のコメントなどは改行してから書き出す。
+			buffer.WriteString("\n")
+		}
+		buffer.WriteString(node.markup)
+		written[node.pointer] = true
+	}
+	writeRootOnce := func(pointer string) {
+		if written[pointer] {
+			return
+		}
+		// order にないノードは最初のルート要素の前に書き出す。
+		if !afterRoot {
+			for _, node := range prolog {
+				if !node.declaration && !referenced[node.pointer] {
+					writeNode(node)
+				}
+			}
+		}
+		writeRoot(rootPointers[pointer])
+		written[pointer] = true
+		afterRoot = true
+	}
+
+	for _, node := range prolog {
+		if node.declaration {
+			writeNode(node)
+		}
+	}
+	for _, pointer := range order {
+		if _, ok := rootPointers[pointer]; ok {
+			writeRootOnce(pointer)
+			continue
+		}
+		for _, node := range prolog {
+			if node.pointer == pointer && !written[pointer] {
+				writeNode(node)
+			}
+		}
+	}
+	for _, name := range rootNames {
+		writeRootOnce(jsonPointer("", name))
+	}
+	// ルート要素がない場合（フラグメント）は、残りのノードを書き出す。
+	for _, node := range prolog {
+		if !written[node.pointer] && !node.declaration {
+			writeNode(node)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/antchfx/xmlquery"
+	"github.com/antchfx/xpath"
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// XPath による値の取り出し（query サブコマンド）
+// ---------------------------------------------------------------------
+
+// 式の結果がノードの集合の場合、要素は変換と同じ既定の形式（@/$ 形式）のオブジェクトに、
+// 属性、テキスト、コメントは文字列にして、一致した順にJSONの配列で出力する。
+// count() などの数値、文字列、真偽値の結果は、その値だけを出力する。
+
+// checkQuery は query サブコマンドと同時に指定できないオプションを確認する。
+func checkQuery() error {
+	if args.Query == nil {
+		return nil
+	}
+	if ToXML {
+		return errors.Errorf("query は --to-xml と同時に指定できません")
+	}
+	if isTableDirectoryFormat() || currentFormat() == FormatSQL || currentFormat() == FormatTOML {
+		return errors.Errorf("query は --format %s と同時に指定できません", currentFormat())
+	}
+	if args.SplitAt != "" || args.Fragment || args.C14N != "" {
+		return errors.Errorf("query は --split-at, --fragment, --c14n と同時に指定できません")
+	}
+	return nil
+}
+
+// queryNamespaces は --ns の prefix=URI の指定を、接頭辞から名前空間URIへの対応にする。
+func queryNamespaces(bindings []string) (map[string]string, error) {
+	namespaces := make(map[string]string)
+	for _, binding := range bindings {
+		prefix, uri, ok := strings.Cut(binding, "=")
+		if !ok || prefix == "" {
+			return nil, errors.Errorf("--ns は prefix=URI の形式で指定してください: %s", binding)
+		}
+		namespaces[prefix] = uri
+	}
+	return namespaces, nil
+}
+
+// QueryXML は入力のXMLに XPath の式を評価し、結果をJSONで出力する。
+func QueryXML(inputString []byte, output io.Writer) {
+	namespaces, err := queryNamespaces(args.Query.Namespaces)
+	if err != nil {
+		panic(err)
+	}
+	expr, err := xpath.CompileWithNS(args.Query.Expression, namespaces)
+	if err != nil {
+		panic(errors.Errorf("XPath の式が不正です: %v", err))
+	}
+
+	options := xmlquery.ParserOptions{Decoder: &xmlquery.DecoderOptions{Strict: true, Entity: queryEntities(inputString)}}
+	if args.HTML {
+		options.Decoder = &xmlquery.DecoderOptions{Strict: false, AutoClose: xml.HTMLAutoClose, Entity: xml.HTMLEntity}
+	}
+	doc, err := xmlquery.ParseWithOptions(bytes.NewReader(inputString), options)
+	if err != nil {
+		panic(errors.Errorf("XMLのパースに失敗しました: %v", err))
+	}
+
+	switch v := expr.Evaluate(xmlquery.CreateXPathNavigator(doc)).(type) {
+	case *xpath.NodeIterator:
+		results := []interface{}{}
+		for v.MoveNext() {
+			navigator, ok := v.Current().(*xmlquery.NodeNavigator)
+			if !ok || isQueryNamespaceNode(navigator) {
+				continue
+			}
+			results = append(results, queryNodeValue(navigator, inputString))
+		}
+		writeQueryResults(output, results)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			panic(errors.Errorf("XPath の式の結果を数値として出力できません: %v", v))
+		}
+		writeQueryValue(output, v)
+	default:
+		writeQueryValue(output, v)
+	}
+}
+
+// queryNodeValue は一致したノードを出力する値にする。
+func queryNodeValue(navigator *xmlquery.NodeNavigator, inputString []byte) interface{} {
+	switch navigator.NodeType() {
+	case xpath.RootNode:
+		// 文書全体は、入力をそのまま変換する。
+		return convertFromDefaultConvention(parseXMLToMap(inputString))
+	case xpath.ElementNode:
+		node := navigator.Current()
+		if node.Type != xmlquery.ElementNode {
+			// 処理命令
+			return navigator.Value()
+		}
+		var buffer bytes.Buffer
+		writeQueryElement(&buffer, node, inheritedNamespaces(node))
+		return convertFromDefaultConvention(parseXMLToMap(buffer.Bytes()))
+	}
+	return navigator.Value()
+}
+
+// writeQueryResults はノードの集合の結果を、JSONの配列、または --ndjson 指定時は1行1ノードの JSON Lines で出力する。
+func writeQueryResults(output io.Writer, results []interface{}) {
+	if !args.NDJSON {
+		writeQueryValue(output, results)
+		return
+	}
+	var buffer bytes.Buffer
+	for _, result := range results {
+		line, err := marshalJSONLine(result)
+		if err != nil {
+			panic(errors.Errorf("JSONへの変換に失敗しました: %v", err))
+		}
+		buffer.Write(line)
+		buffer.WriteString("\n")
+	}
+	writeQueryOutput(output, buffer.Bytes())
+}
+
+// writeQueryValue は値を現在の形式で出力する。
+func writeQueryValue(output io.Writer, v interface{}) {
+	data, err := marshalDocument(v)
+	if err != nil {
+		panic(errors.Errorf("JSONへの変換に失敗しました: %v", err))
+	}
+	writeQueryOutput(output, data)
+}
+
+// writeQueryOutput は出力を書き込む。
+func writeQueryOutput(output io.Writer, data []byte) {
+	// 出力直前に改行コードをCRLFに統一する（バイナリ形式を除く）
+	if !isBinaryFormat() {
+		data = []byte(normalizeNewlinesToCRLF(string(data)))
+	}
+	if _, err := output.Write(data); err != nil {
+		panic(errors.Errorf("JSONデータの書き込みに失敗しました: %v", err))
+	}
+}
+
+// inheritedNamespaces は祖先の要素で宣言され、node で使える名前空間宣言を返す。
+// 一致した要素だけを取り出しても接頭辞を解決できるよう、取り出した要素に宣言を補う。
+func inheritedNamespaces(node *xmlquery.Node) []xmlquery.Attr {
+	declared := make(map[string]bool)
+	for _, attr := range node.Attr {
+		if isQueryNamespaceDecl(attr) {
+			declared[attr.Name.Space+":"+attr.Name.Local] = true
+		}
+	}
+	var inherited []xmlquery.Attr
+	for parent := node.Parent; parent != nil; parent = parent.Parent {
+		for _, attr := range parent.Attr {
+			key := attr.Name.Space + ":" + attr.Name.Local
+			if isQueryNamespaceDecl(attr) && !declared[key] {
+				declared[key] = true
+				inherited = append(inherited, attr)
+			}
+		}
+	}
+	return inherited
+}
+
+// isQueryNamespaceNode はノードが名前空間宣言の属性かどうかを返す。
+// XPath のデータモデルでは名前空間宣言は属性ではなく名前空間ノードのため、//@* などの結果に含めない。
+func isQueryNamespaceNode(navigator *xmlquery.NodeNavigator) bool {
+	if navigator.NodeType() != xpath.AttributeNode {
+		return false
+	}
+	return isQueryNamespaceDecl(xmlquery.Attr{Name: xml.Name{Space: navigator.Prefix(), Local: navigator.LocalName()}})
+}
+
+// isQueryNamespaceDecl は属性が名前空間宣言（xmlns, xmlns:p）かどうかを返す。
+func isQueryNamespaceDecl(attr xmlquery.Attr) bool {
+	return attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns")
+}
+
+// writeQueryElement は要素をXMLとして書き出す。テキストと属性値は既定のエスケープで書き出す。
+func writeQueryElement(buffer *bytes.Buffer, node *xmlquery.Node, extraAttrs []xmlquery.Attr) {
+	switch node.Type {
+	case xmlquery.TextNode:
+		buffer.WriteString(escapeXMLText(node.Data))
+		return
+	case xmlquery.CharDataNode:
+		buffer.WriteString("<![CDATA[" + node.Data + "]]>")
+		return
+	case xmlquery.CommentNode:
+		buffer.WriteString("<!--" + node.Data + "-->")
+		return
+	case xmlquery.ProcessingInstruction:
+		buffer.WriteString("<?" + node.ProcInst.Target)
+		if len(node.ProcInst.Inst) > 0 {
+			buffer.WriteString(" " + string(node.ProcInst.Inst))
+		}
+		buffer.WriteString("?>")
+		return
+	case xmlquery.ElementNode:
+	default:
+		return
+	}
+
+	name := node.Data
+	if node.Prefix != "" {
+		name = node.Prefix + ":" + name
+	}
+	buffer.WriteString("<" + name)
+	for _, attr := range append(append([]xmlquery.Attr{}, node.Attr...), extraAttrs...) {
+		attrName := attr.Name.Local
+		if attr.Name.Space != "" {
+			attrName = attr.Name.Space + ":" + attrName
+		}
+		buffer.WriteString(" " + attrName + "=\"" + escapeXMLAttr(attr.Value) + "\"")
+	}
+	if node.FirstChild == nil {
+		buffer.WriteString("/>")
+		return
+	}
+	buffer.WriteString(">")
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		writeQueryElement(buffer, child, nil)
+	}
+	buffer.WriteString("</" + name + ">")
+}
+
+// queryEntities は入力の DOCTYPE で宣言された実体を返す。
+func queryEntities(inputString []byte) map[string]string {
+	decoder := xml.NewDecoder(bytes.NewReader(inputString))
+	for {
+		token, err := decoder.RawToken()
+		if err != nil {
+			return nil
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			return nil
+		case xml.Directive:
+			if !isDoctypeDirective(t) {
+				continue
+			}
+			doctype, err := parseDoctype(string(t))
+			if err != nil {
+				return nil
+			}
+			entities, err := parseEntityDeclarations(doctype)
+			if err != nil {
+				return nil
+			}
+			return entities
+		}
+	}
+}
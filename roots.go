@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// JSONのトップレベルに複数の要素がある場合の扱い
+// ---------------------------------------------------------------------
+
+// --multiple-roots に指定できる値。
+const (
+	MultipleRootsError    = "error"    // エラーにする（既定）
+	MultipleRootsFragment = "fragment" // ルート要素を並べたXMLフラグメントとして出力する
+	MultipleRootsWrap     = "wrap"     // --wrapper で指定した要素で包んで出力する
+)
+
+// multipleRootsMode は --multiple-roots の値を返す。未指定の場合は error とする。
+func multipleRootsMode() string {
+	if args.MultiRoots == "" {
+		return MultipleRootsError
+	}
+	return strings.ToLower(args.MultiRoots)
+}
+
+// checkMultipleRootsMode は --multiple-roots と --wrapper の指定を確認する。
+func checkMultipleRootsMode() error {
+	switch multipleRootsMode() {
+	case MultipleRootsError, MultipleRootsFragment:
+		return nil
+	case MultipleRootsWrap:
+		if !isValidXMLName(args.Wrapper) {
+			return errors.Errorf("包含要素の名前として使えません: %q", args.Wrapper)
+		}
+		return nil
+	}
+	return errors.Errorf("未対応の --multiple-roots の値です: %v", args.MultiRoots)
+}
+
+// topLevelElementNames はトップレベルの要素のキーを決まった順序で返す。
+// $orderMap にトップレベルの順序（キー ""）が記録されていればその順に、なければ昇順に並べる。
+func topLevelElementNames(root map[string]interface{}, orderMap map[string][]string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range orderMap[""] {
+		if _, exists := root[name]; exists && keys.IsElement(name) && !seen[name] {
+			names = append(names, name)
+			seen[name] = true
+		}
+	}
+	var rest []string
+	for name := range root {
+		if keys.IsElement(name) && !seen[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	return append(names, rest...)
+}
+
+// countTopLevelElements はトップレベルの要素の数を数える。配列の値は要素数だけ数える。
+func countTopLevelElements(root map[string]interface{}, names []string) int {
+	count := 0
+	for _, name := range names {
+		if arr, ok := root[name].([]interface{}); ok {
+			count += len(arr)
+		} else {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ---------------------------------------------------------------------
+// 入力XMLでの書き方の保存（$source, $quote, $empty）
+// ---------------------------------------------------------------------
+
+// 入力XMLでのテキストと属性値の書き方は、既定のエスケープで再現できない場合のみ要素の $source に記録する。
+// $source はテキストキー（"$"）や属性のキー（"@name"）から入力での書き方への対応で、
+// &#x3042; のような文字参照、&copy; のような実体参照、CDATA セクション、エスケープされていない > などを保存する。
+// XMLへの変換時は、記録された書き方を展開した結果が現在の値と一致する場合のみ使う。
+// 値が書き換えられていれば記録は使わず、既定のエスケープで出力する。
+// --entities keep でテキストが文字列と実体参照のノードの配列になる場合は、i 番目の文字列の書き方を "$/i" のキーに記録する。
+//
+// 単一引用符で囲まれた属性値は $quote に、既定と異なる空要素の書き方（<a></a> または <a/>）は $empty に記録する。
+
+// 空要素の書き方。
+const (
+	EmptyElementSelf = "self" // <a/>
+	EmptyElementPair = "pair" // <a></a>
+)
+
+var reSourceAttr = regexp.MustCompile(`([^\s=/<>"']+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+// XMLへの変換時に $source の検証で使う、DOCTYPE で宣言された実体。
+var sourceEntities map[string]string
+
+// recordTextSource はテキストの入力での書き方を記録する。既定のエスケープで再現できる場合は記録を消す。
+func recordTextSource(element map[string]interface{}, text string, raw []byte) {
+	deleteSegmentSources(element)
+	if raw == nil {
+		deleteSource(element, keys.Text)
+		return
+	}
+	if source := normalizeSourceNewlines(string(raw)); source != escapeXMLText(text) {
+		setSource(element, keys.Text, source)
+	} else {
+		deleteSource(element, keys.Text)
+	}
+}
+
+// recordSegmentSources は実体参照のノードを含むテキストについて、文字列ごとの入力での書き方を記録する。
+// 既定のエスケープで再現できる文字列は記録しない。
+func recordSegmentSources(element map[string]interface{}, segments []interface{}, raw []byte) {
+	deleteSource(element, keys.Text)
+	deleteSegmentSources(element)
+	if raw == nil {
+		return
+	}
+	pieces := splitSourceAtEntities(normalizeSourceNewlines(string(raw)), segments)
+	for i, segment := range segments {
+		if text, ok := segment.(string); ok && pieces != nil && pieces[i] != escapeXMLText(text) {
+			setSource(element, textSegmentKey(i), pieces[i])
+		}
+	}
+}
+
+// splitSourceAtEntities はテキストの入力での書き方を実体参照の位置で区切り、segments の文字列ごとの書き方を返す。
+// 戻り値は segments と同じ長さで、実体参照のノードの位置は空文字列になる。対応が取れない場合は nil を返す。
+func splitSourceAtEntities(raw string, segments []interface{}) []string {
+	pieces := make([]string, len(segments))
+	pos := 0
+	for i, segment := range segments {
+		node, ok := segment.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ref := "&" + fmt.Sprintf("%v", node[keys.Entity()]) + ";"
+		idx := strings.Index(raw[pos:], ref)
+		if idx < 0 {
+			return nil
+		}
+		if i > 0 && isStringSegment(segments[i-1]) {
+			pieces[i-1] = raw[pos : pos+idx]
+		} else if idx > 0 {
+			return nil
+		}
+		pos += idx + len(ref)
+	}
+	if n := len(segments); n > 0 && isStringSegment(segments[n-1]) {
+		pieces[n-1] = raw[pos:]
+	} else if pos != len(raw) {
+		return nil
+	}
+	return pieces
+}
+
+func isStringSegment(segment interface{}) bool {
+	_, ok := segment.(string)
+	return ok
+}
+
+// textSegmentKey はテキストの配列の i 番目の文字列の書き方を記録するキー（"$/0" など）を返す。
+func textSegmentKey(i int) string {
+	return keys.Text + "/" + strconv.Itoa(i)
+}
+
+// isTextSegmentKey は key がテキストの配列の文字列の書き方のキーかどうかを返す。
+func isTextSegmentKey(key string) bool {
+	index, ok := strings.CutPrefix(key, keys.Text+"/")
+	if !ok {
+		return false
+	}
+	_, err := strconv.Atoi(index)
+	return err == nil
+}
+
+// deleteSegmentSources はテキストの配列の文字列の書き方の記録を消す。
+func deleteSegmentSources(element map[string]interface{}) {
+	sources, ok := element[keys.Source()].(map[string]interface{})
+	if !ok {
+		return
+	}
+	for key := range sources {
+		if isTextSegmentKey(key) {
+			deleteSource(element, key)
+		}
+	}
+}
+
+// recordAttrSources は開始タグの入力から属性値の書き方を読み取り、既定のエスケープで再現できないものと、
+// 単一引用符で囲まれたものを記録する。属性は入力での並び順のまま t.Attr に入っているため、開始タグの属性と順に対応付ける。
+func recordAttrSources(element map[string]interface{}, t xml.StartElement, raw []byte) {
+	if raw == nil {
+		return
+	}
+	matches := reSourceAttr.FindAllSubmatchIndex(raw, -1)
+	if len(matches) != len(t.Attr) {
+		return
+	}
+	attrOrder, _ := element[keys.AttrOrder()].([]string)
+	for i, loc := range matches {
+		attr := t.Attr[i]
+		if attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns") || i >= len(attrOrder) {
+			continue
+		}
+		var value []byte
+		if loc[4] >= 0 {
+			value = raw[loc[4]:loc[5]]
+		} else {
+			value = raw[loc[6]:loc[7]]
+			quotes, ok := element[keys.Quote()].(map[string]interface{})
+			if !ok {
+				quotes = make(map[string]interface{})
+				element[keys.Quote()] = quotes
+			}
+			quotes[attrOrder[i]] = "'"
+		}
+		if source := normalizeSourceNewlines(string(value)); source != escapeXMLAttr(attr.Value) {
+			setSource(element, attrOrder[i], source)
+		}
+	}
+}
+
+// isSelfClosingTag は開始タグの入力が空要素タグ（<a/>）かどうかを返す。
+func isSelfClosingTag(raw []byte) bool {
+	return bytes.HasSuffix(raw, []byte("/>"))
+}
+
+// defaultEmptyElement は空要素の既定の書き方を返す。table 要素の row の td は <td></td>、それ以外は <a/> と書き出す。
+// path は要素までのJSONのキーの並び。
+func defaultEmptyElement(path []string) string {
+	if n := len(path); n >= 3 && path[n-1] == "td" && path[n-2] == "row" && path[n-3] == "table" {
+		return EmptyElementPair
+	}
+	return EmptyElementSelf
+}
+
+// recordEmptyElement は内容のない要素の書き方が既定と異なる場合に記録する。
+func recordEmptyElement(element map[string]interface{}, path []string, selfClosing bool) {
+	for key := range element {
+		if !keys.IsAttr(key) && !isSourceMeta(key) && key != keys.AttrOrder() {
+			return
+		}
+	}
+	form := EmptyElementPair
+	if selfClosing {
+		form = EmptyElementSelf
+	}
+	if form != defaultEmptyElement(path) {
+		element[keys.Empty()] = form
+	}
+}
+
+// emptyElementForm は要素に記録された空要素の書き方を返す。記録がなければ def を返す。
+func emptyElementForm(element map[string]interface{}, def string) string {
+	switch form := element[keys.Empty()]; form {
+	case EmptyElementSelf, EmptyElementPair:
+		return form.(string)
+	}
+	return def
+}
+
+// isSourceMeta は書き方を記録するメタデータキー（要素の内容ではないもの）かどうかを返す。
+func isSourceMeta(key string) bool {
+	return key == keys.Source() || key == keys.Quote() || key == keys.Empty()
+}
+
+// normalizeSourceNewlines はデコーダーと同様に改行コードをLFにそろえる。
+func normalizeSourceNewlines(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.ReplaceAll(s, "\r", "\n")
+}
+
+func setSource(element map[string]interface{}, key string, source string) {
+	sources, ok := element[keys.Source()].(map[string]interface{})
+	if !ok {
+		sources = make(map[string]interface{})
+		element[keys.Source()] = sources
+	}
+	sources[key] = source
+}
+
+func deleteSource(element map[string]interface{}, key string) {
+	sources, ok := element[keys.Source()].(map[string]interface{})
+	if !ok {
+		return
+	}
+	delete(sources, key)
+	if len(sources) == 0 {
+		delete(element, keys.Source())
+	}
+}
+
+// recordedSource は要素に記録された key の書き方を返す。
+func recordedSource(element map[string]interface{}, key string) (string, bool) {
+	sources, ok := element[keys.Source()].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	source, ok := sources[key].(string)
+	return source, ok
+}
+
+// xmlTextOutput はテキストをXMLに書き出す形にする。記録された書き方が現在の値を表していればそれを使う。
+func xmlTextOutput(element map[string]interface{}, value interface{}) string {
+	return xmlTextOutputFor(element, keys.Text, value)
+}
+
+// xmlTextOutputFor は $source の key に記録された書き方を使って、テキストをXMLに書き出す形にする。
+func xmlTextOutputFor(element map[string]interface{}, key string, value interface{}) string {
+	text := fmt.Sprintf("%v", value)
+	if source, ok := recordedSource(element, key); ok {
+		if decoded, ok := decodeXMLSource("<x>" + source + "</x>"); ok && decoded == text {
+			return source
+		}
+	}
+	return escapeXMLText(text)
+}
+
+// xmlAttrOutput は属性値を引用符で囲んで書き出す形にする。引用符は $quote に記録があればそれを使い、なければ二重引用符とする。
+// 記録された書き方が現在の値を表していればそれを使う。
+func xmlAttrOutput(element map[string]interface{}, attrKey string, value interface{}) string {
+	quote := `"`
+	if quotes, ok := element[keys.Quote()].(map[string]interface{}); ok && quotes[attrKey] == "'" {
+		quote = "'"
+	}
+	text := fmt.Sprintf("%v", value)
+	if source, ok := recordedSource(element, attrKey); ok && !strings.ContainsAny(source, quote+"<") {
+		if decoded, ok := decodeXMLSource("<x a=" + quote + source + quote + "/>"); ok && decoded == text {
+			return quote + source + quote
+		}
+	}
+	return quote + escapeXMLAttr(text) + quote
+}
+
+// decodeXMLSource は1つの要素 x からなるXMLを読み込み、テキストまたは属性 a の値を返す。
+// x の中に要素やコメントなど、テキスト以外のものがある場合は false を返す。
+func decodeXMLSource(document string) (string, bool) {
+	decoder := xml.NewDecoder(strings.NewReader(document))
+	decoder.Entity = sourceEntities
+	var text bytes.Buffer
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return text.String(), true
+		}
+		if err != nil {
+			return "", false
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth > 1 {
+				return "", false
+			}
+			for _, attr := range t.Attr {
+				text.WriteString(attr.Value)
+			}
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			text.Write(t)
+		default:
+			return "", false
+		}
+	}
+}
+
+// doctypeEntities は $doctype で宣言された実体を返す。宣言が不正な場合は nil を返す。
+func doctypeEntities(root map[string]interface{}) map[string]string {
+	value, ok := root[keys.Doctype()]
+	if !ok {
+		return nil
+	}
+	doctype, err := doctypeObject(value)
+	if err != nil {
+		return nil
+	}
+	entities, err := parseEntityDeclarations(doctype)
+	if err != nil {
+		return nil
+	}
+	return entities
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// 自己終了タグで書かれた td が、XMLに戻したときも <td/> になることを確認する。
+func TestSelfClosingTableCellRoundTrip(t *testing.T) {
+	root := parseXMLToMap([]byte(`<table><row><td/><td></td><td>x</td></row></table>`))
+	data, err := json.Marshal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if err := writeXMLDocument(&buffer, decoded, false); err != nil {
+		t.Fatal(err)
+	}
+	got := buffer.String()
+	if !strings.Contains(got, "<td/>") || !strings.Contains(got, "<td></td>") {
+		t.Errorf("空要素の書き方が保たれていません:\n%s", got)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// 要素のパスによるレコード分割（XMLからJSON Linesへの変換）
+// ---------------------------------------------------------------------
+
+// checkSplitAt は --split-at と同時に指定できないオプションを確認する。
+func checkSplitAt() error {
+	if args.SplitAt == "" {
+		return nil
+	}
+	if ToXML {
+		return errors.Errorf("--split-at はXMLからJSONへの変換でのみ使えます")
+	}
+	if isTableDirectoryFormat() || currentFormat() == FormatSQL {
+		return errors.Errorf("--split-at は --format %s と同時に指定できません", currentFormat())
+	}
+	return nil
+}
+
+// parseSplitPath は --split-at のパス（/root/items/item の形式）を要素名の並びに分解する。
+// 各要素名には "*" を指定でき、任意の要素に一致する。
+func parseSplitPath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, errors.Errorf("--split-at のパスは / で始まる絶対パスで指定してください: %q", path)
+	}
+	steps := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for _, step := range steps {
+		if step == "" {
+			return nil, errors.Errorf("--split-at のパスに空の要素名があります: %q", path)
+		}
+	}
+	return steps, nil
+}
+
+// splitStepMatches はパスの1段分が要素に一致するかどうかを返す。
+// ローカル名、またはJSONのキー（名前空間URI付きの名前）のどちらかと一致すればよい。
+func splitStepMatches(step string, name xml.Name, key string) bool {
+	return step == "*" || step == name.Local || step == key
+}
+
+// 分割対象の要素の祖先。
+type splitAncestor struct {
+	key     string                 // JSONのキー
+	element map[string]interface{} // 属性のみを格納した要素
+	matched bool                   // ここまでのパスが --split-at と一致しているか
+}
+
+// convertXMLToSplitRecords は --split-at のパスに一致する要素ごとに、1行1レコードのJSON Linesとして出力する。
+// 入力は順に読み進め、一致した要素の部分木だけを組み立てて1レコードずつ書き出すため、
+// 文書全体の木も入力全体も保持しない。
+func convertXMLToSplitRecords(input io.Reader, output io.Writer) {
+	steps, err := parseSplitPath(args.SplitAt)
+	if err != nil {
+		panic(err)
+	}
+
+	decoder := newXMLTokenReaderFrom(input)
+	var ancestors []splitAncestor
+	var b *xmlTreeBuilder // レコードの要素の中にいる間だけ nil 以外になる
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			panic(errors.Errorf("XMLのパースに失敗しました: %v", err))
+		}
+
+		if b != nil {
+			b.handleToken(token, decoder.Source())
+			if _, ok := token.(xml.EndElement); ok && b.depth() == 0 {
+				record := b.result()
+				if args.SplitContext {
+					record = wrapRecordWithAncestors(record, ancestors)
+				}
+				writeSplitRecord(output, convertFromDefaultConvention(record))
+				b = nil
+			}
+			continue
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			key, element := elementFromStartElement(t)
+			depth := len(ancestors)
+			matched := depth < len(steps) && (depth == 0 || ancestors[depth-1].matched) && splitStepMatches(steps[depth], t.Name, key)
+			if matched && depth == len(steps)-1 {
+				b = newXMLTreeBuilder()
+				b.handleToken(t, decoder.Source())
+				continue
+			}
+			ancestors = append(ancestors, splitAncestor{key: key, element: element, matched: matched})
+		case xml.EndElement:
+			if len(ancestors) > 0 {
+				ancestors = ancestors[:len(ancestors)-1]
+			}
+		}
+	}
+}
+
+// wrapRecordWithAncestors はレコードを祖先の要素（属性のみ）で包み、文書内の位置が分かるようにする。
+// $orderMap のパスも祖先のパスを前に付けたものに置き換える。
+func wrapRecordWithAncestors(record map[string]interface{}, ancestors []splitAncestor) map[string]interface{} {
+	if len(ancestors) == 0 {
+		return record
+	}
+	var ancestorKeys []string
+	for _, a := range ancestors {
+		ancestorKeys = append(ancestorKeys, a.key)
+	}
+	prefix := strings.Join(ancestorKeys, "/")
+
+	wrapped := make(map[string]interface{})
+	inner := make(map[string]interface{})
+	for key, value := range record {
+		if keys.IsElement(key) {
+			inner[key] = value
+		} else if key != keys.OrderMap() {
+			wrapped[key] = value
+		}
+	}
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		element := make(map[string]interface{})
+		for key, value := range ancestors[i].element {
+			element[key] = value
+		}
+		for key, value := range inner {
+			element[key] = value
+		}
+		inner = map[string]interface{}{ancestors[i].key: element}
+	}
+	for key, value := range inner {
+		wrapped[key] = value
+	}
+
+	orderMap := make(map[string][]string)
+	for i := 1; i < len(ancestorKeys); i++ {
+		orderMap[strings.Join(ancestorKeys[:i], "/")] = []string{ancestorKeys[i]}
+	}
+	for key := range record {
+		if keys.IsElement(key) {
+			orderMap[prefix] = append(orderMap[prefix], key)
+		}
+	}
+	if recordOrder, ok := record[keys.OrderMap()].(map[string][]string); ok {
+		for path, names := range recordOrder {
+			orderMap[prefix+"/"+path] = names
+		}
+	}
+	wrapped[keys.OrderMap()] = orderMap
+	return wrapped
+}
+
+// writeSplitRecord はレコードを1行のJSONとして書き出す。
+func writeSplitRecord(output io.Writer, record map[string]interface{}) {
+	line, err := marshalJSONLine(record)
+	if err != nil {
+		panic(errors.Errorf("JSONへの変換に失敗しました: %v", err))
+	}
+	// 他の出力と同様に改行コードはCRLFとする。
+	if _, err := output.Write(append(line, '\r', '\n')); err != nil {
+		panic(errors.Errorf("JSONデータの書き込みに失敗しました: %v", err))
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// table/col/row/td 形式の文書のSQLへの出力
+// ---------------------------------------------------------------------
+
+// 対応しているSQLの方言。
+const (
+	SQLDialectSQLite   = "sqlite"
+	SQLDialectPostgres = "postgres"
+)
+
+// 現在のSQLの方言を返す。
+func currentSQLDialect() string {
+	switch d := strings.ToLower(args.SQLDialect); d {
+	case "", "sqlite3":
+		return SQLDialectSQLite
+	case "postgresql", "pg":
+		return SQLDialectPostgres
+	default:
+		return d
+	}
+}
+
+// SQLの方言が対応しているものかどうかを確認する。
+func checkSQLDialect() error {
+	switch currentSQLDialect() {
+	case SQLDialectSQLite, SQLDialectPostgres:
+		return nil
+	}
+	return errors.Errorf("未対応のSQLの方言です: %v", args.SQLDialect)
+}
+
+// ConvertXMLToSQL は table 要素ごとに CREATE TABLE 文と、行ごとの INSERT 文を出力する。
+// 列の型は col 要素の def 属性から決め、key="yes" の列を主キーとする。全体を1つのトランザクションにまとめる。
+func ConvertXMLToSQL(inputString []byte, output io.Writer) {
+	if err := checkSQLDialect(); err != nil {
+		panic(err)
+	}
+	root := parseXMLToMap(inputString)
+	if err := checkTableDocument(root); err != nil {
+		panic(err)
+	}
+
+	writer := bufio.NewWriter(output)
+	writeLine := func(line string) {
+		// 他の出力と同様に改行コードはCRLFとする。
+		if _, err := writer.WriteString(line + "\r\n"); err != nil {
+			panic(errors.Errorf("SQLの書き込みに失敗しました: %v", err))
+		}
+	}
+
+	writeLine("BEGIN;")
+	count := 0
+	err := walkTables(root, func(table map[string]interface{}) error {
+		name, ok := table[keys.Attr("name")].(string)
+		if !ok || name == "" {
+			return errors.Errorf("name 属性のない table 要素があります")
+		}
+		columns, err := sqlColumns(name, table)
+		if err != nil {
+			return err
+		}
+		writeLine("")
+		writeLine(sqlCreateTable(name, columns))
+
+		for i, row := range asElementArray(table["row"]) {
+			rowMap, _ := row.(map[string]interface{})
+			tds := asElementArray(rowMap["td"])
+			if len(tds) > len(columns) {
+				return errors.Errorf("テーブル %q %d行目: td の数が %d 個で、列の数 %d 個を超えています", name, i+1, len(tds), len(columns))
+			}
+			values := make([]string, len(columns))
+			for j := range columns {
+				var td interface{}
+				if j < len(tds) {
+					td = tds[j]
+				}
+				value, err := sqlValue(columns[j], td)
+				if err != nil {
+					return errors.Errorf("テーブル %q %d行目 %d列目（%s）: %v", name, i+1, j+1, columns[j].name, err)
+				}
+				values[j] = value
+			}
+			writeLine(sqlInsert(name, columns, values))
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if count == 0 {
+		panic(errors.Errorf("table 要素がありません"))
+	}
+	writeLine("")
+	writeLine("COMMIT;")
+	if err := writer.Flush(); err != nil {
+		panic(errors.Errorf("SQLの書き込みに失敗しました: %v", err))
+	}
+}
+
+// sqlColumns は col 要素から列定義を作る。def 属性のない列は null を許す文字列の列とする。
+func sqlColumns(name string, table map[string]interface{}) ([]tableColumnDef, error) {
+	var columns []tableColumnDef
+	for i, col := range asElementArray(table["col"]) {
+		colMap, _ := col.(map[string]interface{})
+		c := tableColumnDef{kind: 's', nullable: true}
+		if def, ok := colMap[keys.Attr("def")]; ok {
+			parsed, err := parseTableColumnDef(fmt.Sprintf("%v", def))
+			if err != nil {
+				return nil, errors.Errorf("テーブル %q %d列目: %v", name, i+1, err)
+			}
+			c = parsed
+		}
+		c.name = elementText(col)
+		if c.name == "" {
+			return nil, errors.Errorf("テーブル %q %d列目: 列名が空です", name, i+1)
+		}
+		if key, ok := colMap[keys.Attr("key")]; ok && fmt.Sprintf("%v", key) == "yes" {
+			c.key = true
+		}
+		columns = append(columns, c)
+	}
+	if len(columns) == 0 {
+		return nil, errors.Errorf("テーブル %q に col 要素がありません", name)
+	}
+	return columns, nil
+}
+
+// sqlColumnType は列定義に対応するSQLの型を返す。
+// 二進データの列（v0）は、XMLに含まれるのがストリームのファイル名（td の href 属性）のため文字列とする。
+func sqlColumnType(c tableColumnDef) string {
+	switch c.kind {
+	case 'i':
+		if c.size == 2 {
+			return "SMALLINT"
+		}
+		return "INTEGER"
+	case 's', 'l':
+		if c.size > 0 {
+			return fmt.Sprintf("VARCHAR(%d)", c.size)
+		}
+	}
+	return "TEXT"
+}
+
+// sqlCreateTable は CREATE TABLE 文を作る。
+func sqlCreateTable(name string, columns []tableColumnDef) string {
+	var lines []string
+	var primaryKeys []string
+	for _, c := range columns {
+		line := "\t" + sqlIdentifier(c.name) + " " + sqlColumnType(c)
+		if !c.nullable {
+			line += " NOT NULL"
+		}
+		lines = append(lines, line)
+		if c.key {
+			primaryKeys = append(primaryKeys, sqlIdentifier(c.name))
+		}
+	}
+	if len(primaryKeys) > 0 {
+		lines = append(lines, "\tPRIMARY KEY ("+strings.Join(primaryKeys, ", ")+")")
+	}
+	return "CREATE TABLE " + sqlIdentifier(name) + " (\r\n" + strings.Join(lines, ",\r\n") + "\r\n);"
+}
+
+// sqlInsert は INSERT 文を作る。
+func sqlInsert(name string, columns []tableColumnDef, values []string) string {
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = sqlIdentifier(c.name)
+	}
+	return "INSERT INTO " + sqlIdentifier(name) + " (" + strings.Join(names, ", ") + ") VALUES (" + strings.Join(values, ", ") + ");"
+}
+
+// sqlValue は td の値をSQLのリテラルにする。空の値は NULL（NOT NULL の文字列の列では空文字列）、整数の列の値は引用符なしで出力する。
+// 列の型に合わない値（整数の列の整数でない値、範囲外の値、最大長を超える文字列、NOT NULL の整数の列の空の値）はエラーにする。
+func sqlValue(c tableColumnDef, td interface{}) (string, error) {
+	value := elementText(td)
+	if tdMap, ok := td.(map[string]interface{}); ok && c.kind == 'v' {
+		if href, ok := tdMap[keys.Attr("href")]; ok {
+			value = fmt.Sprintf("%v", href)
+		}
+	}
+	if value == "" {
+		switch {
+		case c.nullable:
+			return "NULL", nil
+		case c.kind == 'i':
+			return "", errors.Errorf("NOT NULL の整数の列の値が空です")
+		}
+		return "''", nil
+	}
+	if message := checkTableValue(c, value); message != "" {
+		return "", errors.New(message)
+	}
+	if c.kind == 'i' {
+		n, _ := strconv.ParseInt(value, 10, 64)
+		return strconv.FormatInt(n, 10), nil
+	}
+	return sqlStringLiteral(value), nil
+}
+
+// sqlIdentifier は識別子を二重引用符で囲む。識別子中の二重引用符は重ねてエスケープする。
+func sqlIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// sqlStringLiteral は文字列を単一引用符で囲む。
+// 引用符は重ねてエスケープする。PostgreSQL では改行などの制御文字を含む場合に E'...' 形式とし、バックスラッシュもエスケープする。
+func sqlStringLiteral(value string) string {
+	quoted := strings.ReplaceAll(value, "'", "''")
+	if currentSQLDialect() == SQLDialectPostgres && strings.ContainsAny(value, "\\\r\n\t") {
+		quoted = strings.NewReplacer(`\`, `\\`, "\r", `\r`, "\n", `\n`, "\t", `\t`).Replace(quoted)
+		return "E'" + quoted + "'"
+	}
+	return "'" + quoted + "'"
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// MSI テーブルの列定義による検証
+// ---------------------------------------------------------------------
+
+// 列定義（col 要素の def 属性。s72, I2, L0, v0 など）を解析した結果。
+type tableColumnDef struct {
+	name     string
+	kind     byte // 's'（文字列）, 'l'（ローカライズ可能な文字列）, 'i'（整数）, 'v'（二進データ）
+	nullable bool // 型の文字が大文字の場合は空（null）を許す
+	size     int  // 文字列の最大長（0 は無制限）、整数のバイト数
+	key      bool
+}
+
+// parseTableColumnDef は列定義を解析する。
+func parseTableColumnDef(def string) (tableColumnDef, error) {
+	var c tableColumnDef
+	if len(def) < 2 {
+		return c, errors.Errorf("列の型定義 %q が不正です", def)
+	}
+	kind := def[0]
+	switch kind {
+	case 's', 'l', 'i', 'v':
+	case 'S', 'L', 'I', 'V':
+		c.nullable = true
+		kind += 'a' - 'A'
+	default:
+		return c, errors.Errorf("列の型定義 %q の型 %q は s, l, i, v のいずれかである必要があります", def, def[:1])
+	}
+	size, err := strconv.Atoi(def[1:])
+	if err != nil || size < 0 {
+		return c, errors.Errorf("列の型定義 %q の長さが数値ではありません", def)
+	}
+	if kind == 'i' && size != 2 && size != 4 {
+		return c, errors.Errorf("整数の列の型定義 %q は i2 または i4 である必要があります", def)
+	}
+	c.kind = kind
+	c.size = size
+	return c, nil
+}
+
+// validateTableDocument は文書中の table 要素の各行を列定義に照らして検証し、違反を行と列の位置付きで返す。
+// 行ごとの td の数、空（null）を許さない列、整数の列の値と範囲、文字列の長さ、主キーの重複を確認する。
+func validateTableDocument(root map[string]interface{}) []string {
+	var violations []string
+	addf := func(format string, a ...interface{}) {
+		violations = append(violations, fmt.Sprintf(format, a...))
+	}
+
+	walkTables(root, func(table map[string]interface{}) error {
+		name := fmt.Sprintf("%v", table[keys.Attr("name")])
+
+		var columns []tableColumnDef
+		validColumns := true
+		for i, col := range asElementArray(table["col"]) {
+			colMap, _ := col.(map[string]interface{})
+			def, ok := colMap[keys.Attr("def")]
+			if !ok {
+				// def 属性のない文書は列の型を検証できないため、行数のみ確認する。
+				validColumns = false
+				columns = append(columns, tableColumnDef{name: elementText(col)})
+				continue
+			}
+			c, err := parseTableColumnDef(fmt.Sprintf("%v", def))
+			if err != nil {
+				addf("テーブル %q %d列目（%s）: %v", name, i+1, elementText(col), err)
+				validColumns = false
+			}
+			c.name = elementText(col)
+			if key, ok := colMap[keys.Attr("key")]; ok && fmt.Sprintf("%v", key) == "yes" {
+				c.key = true
+			}
+			columns = append(columns, c)
+		}
+
+		primaryKeys := make(map[string]int)
+		for i, row := range asElementArray(table["row"]) {
+			rowMap, _ := row.(map[string]interface{})
+			tds := asElementArray(rowMap["td"])
+			if len(tds) != len(columns) {
+				addf("テーブル %q %d行目: td の数が %d 個ですが、列は %d 個です", name, i+1, len(tds), len(columns))
+			}
+			if !validColumns {
+				continue
+			}
+			var keyValues []string
+			for j, td := range tds {
+				if j >= len(columns) {
+					break
+				}
+				c := columns[j]
+				value := elementText(td)
+				if tdMap, ok := td.(map[string]interface{}); ok && c.kind == 'v' {
+					if href, ok := tdMap[keys.Attr("href")]; ok {
+						value = fmt.Sprintf("%v", href)
+					}
+				}
+				if message := checkTableValue(c, value); message != "" {
+					addf("テーブル %q %d行目 %d列目（%s）: %s", name, i+1, j+1, c.name, message)
+				}
+				if c.key {
+					keyValues = append(keyValues, value)
+				}
+			}
+			if len(keyValues) > 0 {
+				key := strings.Join(keyValues, "\t")
+				if first, exists := primaryKeys[key]; exists {
+					addf("テーブル %q %d行目: 主キー %q が %d行目と重複しています", name, i+1, keyValues, first)
+				} else {
+					primaryKeys[key] = i + 1
+				}
+			}
+		}
+		return nil
+	})
+	return violations
+}
+
+// checkTableValue は値が列定義に合っているかを確認し、合っていない場合は理由を返す。
+func checkTableValue(c tableColumnDef, value string) string {
+	if value == "" {
+		if !c.nullable {
+			return "空にできない列です"
+		}
+		return ""
+	}
+	switch c.kind {
+	case 'i':
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Sprintf("整数ではありません: %q", value)
+		}
+		// MSI の整数の列では最小値（0x8000, 0x80000000）は null を表すため使えない。
+		limit := int64(32767)
+		if c.size == 4 {
+			limit = 2147483647
+		}
+		if n < -limit || n > limit {
+			return fmt.Sprintf("%d バイトの整数の範囲（%d～%d）を超えています: %s", c.size, -limit, limit, value)
+		}
+	case 's', 'l':
+		if length := utf8.RuneCountInString(value); c.size > 0 && length > c.size {
+			return fmt.Sprintf("文字列の長さが %d 文字で、最大長 %d 文字を超えています", length, c.size)
+		}
+	}
+	return ""
+}
+
+// checkTableDocument は --validate-tables 指定時にテーブルを検証し、違反があればエラーを返す。
+func checkTableDocument(root map[string]interface{}) error {
+	if !args.ValidateTables {
+		return nil
+	}
+	if violations := validateTableDocument(root); len(violations) > 0 {
+		return errors.Errorf("テーブルの内容が列の定義と一致しません（%d件）:\n%s", len(violations), strings.Join(violations, "\n"))
+	}
+	return nil
+}
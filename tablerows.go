@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------
+// table 要素の行を列名をキーとするオブジェクトで表現する（--table-rows）
+// ---------------------------------------------------------------------
+
+// tableRowsToObjects は各 table 要素の row を、col の内容（列名）をキーとするオブジェクトの配列に置き換える。
+// テキストのみの td は文字列、空の td は空文字列とし、属性を持つ td は $attrOrder を含めて td のオブジェクトのまま値とする。
+func tableRowsToObjects(root map[string]interface{}) error {
+	return walkTables(root, func(table map[string]interface{}) error {
+		name := fmt.Sprintf("%v", table[keys.Attr("name")])
+		columns := tableColumnNames(table)
+		seen := make(map[string]bool)
+		for i, column := range columns {
+			if seen[column] {
+				return errors.Errorf("テーブル %q %d列目: 列名 %q が重複しているため、行をオブジェクトにできません", name, i+1, column)
+			}
+			seen[column] = true
+		}
+
+		rows, ok := table["row"]
+		if !ok {
+			return nil
+		}
+		var objects []interface{}
+		for i, row := range asElementArray(rows) {
+			rowMap, ok := row.(map[string]interface{})
+			if !ok {
+				return errors.Errorf("テーブル %q %d行目: row がオブジェクトではありません", name, i+1)
+			}
+			for key := range rowMap {
+				if key != "td" {
+					return errors.Errorf("テーブル %q %d行目: td 以外の内容（%s）を持つ row はオブジェクトにできません", name, i+1, key)
+				}
+			}
+			tds := asElementArray(rowMap["td"])
+			if len(tds) > len(columns) {
+				return errors.Errorf("テーブル %q %d行目: td の数が %d 個で、列の数 %d 個を超えています", name, i+1, len(tds), len(columns))
+			}
+			object := make(map[string]interface{})
+			for j, td := range tds {
+				object[columns[j]] = tableCellValue(td)
+			}
+			objects = append(objects, object)
+		}
+		table["row"] = objects
+		return nil
+	})
+}
+
+// tableCellValue は td を行のオブジェクトの値に変換する。
+func tableCellValue(td interface{}) interface{} {
+	tdMap, ok := td.(map[string]interface{})
+	if !ok {
+		return td
+	}
+	if len(tdMap) == 0 {
+		return ""
+	}
+	if text, ok := tdMap[keys.Text].(string); ok && len(tdMap) == 1 && text != "" {
+		return text
+	}
+	return tdMap
+}
+
+// tableObjectsToRows は tableRowsToObjects の逆変換を行い、col/row/td の形に戻す。
+// 列名の並びは col の順とし、値のない列は空の td とする。ただし末尾の値のない列の td は出力しない。
+func tableObjectsToRows(root map[string]interface{}) error {
+	return walkTables(root, func(table map[string]interface{}) error {
+		name := fmt.Sprintf("%v", table[keys.Attr("name")])
+		columns := tableColumnNames(table)
+		index := make(map[string]int)
+		for i, column := range columns {
+			index[column] = i
+		}
+
+		rows, ok := table["row"]
+		if !ok {
+			return nil
+		}
+		var rebuilt []interface{}
+		for i, row := range asElementArray(rows) {
+			object, ok := row.(map[string]interface{})
+			if !ok {
+				return errors.Errorf("テーブル %q %d行目: 行はオブジェクトである必要があります（%s）", name, i+1, jsonTypeName(row))
+			}
+			count := 0
+			for column := range object {
+				j, ok := index[column]
+				if !ok {
+					return errors.Errorf("テーブル %q %d行目: 列 %q は col に定義されていません", name, i+1, column)
+				}
+				if j+1 > count {
+					count = j + 1
+				}
+			}
+			tds := make([]interface{}, 0, count)
+			for _, column := range columns[:count] {
+				td, err := tableCellToTD(object[column])
+				if err != nil {
+					return errors.Errorf("テーブル %q %d行目 列 %q: %v", name, i+1, column, err)
+				}
+				tds = append(tds, td)
+			}
+			rebuilt = append(rebuilt, map[string]interface{}{"td": tds})
+		}
+		table["row"] = rebuilt
+		return nil
+	})
+}
+
+// tableCellToTD は行のオブジェクトの値を td に変換する。
+func tableCellToTD(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return map[string]interface{}{}, nil
+	case map[string]interface{}:
+		return v, nil
+	case []interface{}:
+		return nil, errors.Errorf("値に配列は使えません")
+	case string:
+		if v == "" {
+			return map[string]interface{}{}, nil
+		}
+	}
+	return map[string]interface{}{keys.Text: value}, nil
+}
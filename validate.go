@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ---------------------------------------------------------------------
+// JSONの構造検証
+// ---------------------------------------------------------------------
+
+// jsonPointer はJSON Pointer（RFC 6901）形式のパスを作成する。
+func jsonPointer(parent string, token string) string {
+	token = strings.ReplaceAll(token, "~", "~0")
+	token = strings.ReplaceAll(token, "/", "~1")
+	return parent + "/" + token
+}
+
+// JSONの値の型名を返す（エラーメッセージ用）。
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "オブジェクト"
+	case []interface{}:
+		return "配列"
+	case string:
+		return "文字列"
+	case float64:
+		return "数値"
+	case bool:
+		return "真偽値"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// スカラー値（文字列、数値、真偽値、null）かどうか。
+func isJSONScalar(value interface{}) bool {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return true
+}
+
+// 検証結果を蓄積する。
+type jsonValidator struct {
+	violations []string
+}
+
+func (v *jsonValidator) addf(path string, format string, a ...interface{}) {
+	if path == "" {
+		path = "/"
+	}
+	v.violations = append(v.violations, fmt.Sprintf("%s: %s", path, fmt.Sprintf(format, a...)))
+}
+
+// validateJSONDocument は既定の形式のJSONが変換可能な構造になっているかを検証し、違反をJSONのパス付きで返す。
+// requireRoot が true の場合、ルート要素がないことも違反とする。
+func validateJSONDocument(root map[string]interface{}, requireRoot bool) []string {
+	v := &jsonValidator{}
+
+	elementCount := 0
+	for _, key := range sortedKeys(root) {
+		value := root[key]
+		path := jsonPointer("", key)
+		switch {
+		case key == keys.OrderMap():
+			v.validateOrderMap(path, value)
+		case key == keys.PI():
+			v.validatePIs(path, value)
+		case key == keys.Comment():
+			v.validateComments(path, value)
+		case key == keys.Doctype():
+			v.validateDoctype(path, value)
+		case key == keys.NodeOrder():
+			v.validateNodeOrder(path, value)
+		case keys.IsMeta(key):
+			v.addf(path, "%s はトップレベルでは使えません", key)
+		case keys.IsAttr(key):
+			v.addf(path, "トップレベルに属性は置けません")
+		default:
+			v.validateUnknownReservedKey(path, key)
+			if arr, ok := value.([]interface{}); ok {
+				elementCount += len(arr)
+			} else {
+				elementCount++
+			}
+			v.validateElementValue(path, value, true)
+		}
+	}
+	if requireRoot && elementCount == 0 {
+		v.addf("", "ルート要素がありません")
+	}
+	return v.violations
+}
+
+// 要素の値（オブジェクト、スカラー、またはそれらの配列）を検証する。
+func (v *jsonValidator) validateElementValue(path string, value interface{}, allowArray bool) {
+	switch val := value.(type) {
+	case map[string]interface{}:
+		v.validateElement(path, val)
+	case []interface{}:
+		if !allowArray {
+			v.addf(path, "配列の中に配列は置けません")
+			return
+		}
+		for i, item := range val {
+			v.validateElementValue(fmt.Sprintf("%s/%d", path, i), item, false)
+		}
+	}
+}
+
+// 要素オブジェクトを検証する。
+func (v *jsonValidator) validateElement(path string, element map[string]interface{}) {
+	for _, key := range sortedKeys(element) {
+		value := element[key]
+		childPath := jsonPointer(path, key)
+		switch {
+		case key == keys.Xmlns():
+			v.validateXmlns(childPath, value)
+		case keys.IsAttr(key):
+			if key == keys.AttrPrefix {
+				v.addf(childPath, "属性名が空です")
+			} else if !isJSONScalar(value) {
+				v.addf(childPath, "属性値は文字列、数値、真偽値のいずれかである必要があります（%s）", jsonTypeName(value))
+			}
+		case key == keys.Text:
+			if segments, ok := value.([]interface{}); ok {
+				v.validateTextSegments(childPath, segments)
+			} else if !isJSONScalar(value) {
+				v.addf(childPath, "テキストは文字列、数値、真偽値、または文字列と実体参照の配列である必要があります（%s）", jsonTypeName(value))
+			}
+		case key == keys.Raw():
+			if !isJSONScalar(value) {
+				v.addf(childPath, "テキストは文字列、数値、真偽値のいずれかである必要があります（%s）", jsonTypeName(value))
+			}
+		case key == keys.CDATA():
+			if !isJSONScalar(value) {
+				v.addf(childPath, "CDATA は文字列である必要があります（%s）", jsonTypeName(value))
+			} else if strings.Contains(fmt.Sprintf("%v", value), "]]>") {
+				v.addf(childPath, "CDATA に \"]]>\" は含められません")
+			}
+		case key == keys.AttrOrder():
+			v.validateAttrOrder(childPath, value)
+		case key == keys.Source():
+			v.validateSource(childPath, value)
+		case key == keys.Quote():
+			v.validateQuote(childPath, value)
+		case key == keys.Empty():
+			if value != EmptyElementSelf && value != EmptyElementPair {
+				v.addf(childPath, "%s は %q または %q である必要があります", keys.Empty(), EmptyElementSelf, EmptyElementPair)
+			}
+		case keys.IsMeta(key):
+			v.addf(childPath, "%s はトップレベルでのみ使えます", key)
+		default:
+			if key == "" {
+				v.addf(childPath, "要素名が空です")
+				continue
+			}
+			v.validateUnknownReservedKey(childPath, key)
+			v.validateElementValue(childPath, value, true)
+		}
+	}
+}
+
+// 文字列と実体参照のノード（{"$entity": 名前}）からなるテキストを検証する。
+func (v *jsonValidator) validateTextSegments(path string, segments []interface{}) {
+	for i, segment := range segments {
+		segmentPath := fmt.Sprintf("%s/%d", path, i)
+		switch s := segment.(type) {
+		case map[string]interface{}:
+			name, ok := s[keys.Entity()].(string)
+			if !ok || len(s) != 1 {
+				v.addf(segmentPath, "実体参照は %q のみを持つオブジェクトである必要があります", keys.Entity())
+			} else if !isValidXMLName(name) {
+				v.addf(jsonPointer(segmentPath, keys.Entity()), "実体名として使えない名前です: %q", name)
+			}
+		case []interface{}:
+			v.addf(segmentPath, "テキストの配列の中に配列は置けません")
+		}
+	}
+}
+
+// $source（テキストと属性値の入力での書き方）を検証する。
+func (v *jsonValidator) validateSource(path string, value interface{}) {
+	sources, ok := value.(map[string]interface{})
+	if !ok {
+		v.addf(path, "%s はオブジェクトである必要があります（%s）", keys.Source(), jsonTypeName(value))
+		return
+	}
+	for _, key := range sortedKeys(sources) {
+		if key != keys.Text && !keys.IsAttr(key) && !isTextSegmentKey(key) {
+			v.addf(jsonPointer(path, key), "%s のキーはテキストキー、テキストの配列の位置（%s）か属性のキーである必要があります", keys.Source(), textSegmentKey(0))
+		}
+		if _, ok := sources[key].(string); !ok {
+			v.addf(jsonPointer(path, key), "書き方は文字列である必要があります（%s）", jsonTypeName(sources[key]))
+		}
+	}
+}
+
+// $quote（属性値を囲む引用符）を検証する。
+func (v *jsonValidator) validateQuote(path string, value interface{}) {
+	quotes, ok := value.(map[string]interface{})
+	if !ok {
+		v.addf(path, "%s はオブジェクトである必要があります（%s）", keys.Quote(), jsonTypeName(value))
+		return
+	}
+	for _, key := range sortedKeys(quotes) {
+		if !keys.IsAttr(key) {
+			v.addf(jsonPointer(path, key), "%s のキーは属性のキーである必要があります", keys.Quote())
+		}
+		if quote := quotes[key]; quote != "'" && quote != `"` {
+			v.addf(jsonPointer(path, key), "引用符は \"'\" または '\"' である必要があります")
+		}
+	}
+}
+
+// $doctype（以前の形式の文字列、または構造化したオブジェクト）を検証する。
+func (v *jsonValidator) validateDoctype(path string, value interface{}) {
+	switch doctype := value.(type) {
+	case string:
+		if !strings.HasPrefix(strings.TrimSpace(doctype), "<!DOCTYPE") {
+			v.addf(path, "DOCTYPE は \"<!DOCTYPE\" で始まる必要があります")
+		}
+	case map[string]interface{}:
+		v.validateDoctypeFields(path, doctype, map[string]bool{"name": true}, map[string]bool{"publicId": true, "systemId": true, "subset": true})
+		if _, ok := doctype["publicId"]; ok {
+			if _, ok := doctype["systemId"]; !ok {
+				v.addf(jsonPointer(path, "publicId"), "publicId を指定する場合は systemId も必要です")
+			}
+		}
+		subset, ok := doctype["subset"]
+		if !ok {
+			return
+		}
+		decls, ok := subset.([]interface{})
+		if !ok {
+			v.addf(jsonPointer(path, "subset"), "subset は配列である必要があります（%s）", jsonTypeName(subset))
+			return
+		}
+		for i, item := range decls {
+			v.validateDoctypeDecl(fmt.Sprintf("%s/%d", jsonPointer(path, "subset"), i), item)
+		}
+	default:
+		v.addf(path, "DOCTYPE は文字列またはオブジェクトである必要があります（%s）", jsonTypeName(value))
+	}
+}
+
+// 内部サブセットの宣言を1つ検証する。
+func (v *jsonValidator) validateDoctypeDecl(path string, item interface{}) {
+	decl, ok := item.(map[string]interface{})
+	if !ok {
+		v.addf(path, "宣言はオブジェクトである必要があります（%s）", jsonTypeName(item))
+		return
+	}
+	required := map[string]bool{"type": true}
+	optional := map[string]bool{}
+	switch decl["type"] {
+	case DoctypeDeclElement:
+		required["name"], required["content"] = true, true
+	case DoctypeDeclAttlist:
+		required["name"], required["attributes"] = true, true
+	case DoctypeDeclEntity:
+		required["name"] = true
+		optional["parameter"], optional["value"], optional["publicId"], optional["systemId"], optional["notation"] = true, true, true, true, true
+		_, hasValue := decl["value"]
+		_, hasSystem := decl["systemId"]
+		if hasValue == hasSystem {
+			v.addf(path, "実体の宣言には value または systemId のどちらか一方が必要です")
+		}
+		if _, ok := decl["parameter"].(bool); !ok && decl["parameter"] != nil {
+			v.addf(jsonPointer(path, "parameter"), "parameter は真偽値である必要があります")
+		}
+	case DoctypeDeclNotation:
+		required["name"] = true
+		optional["publicId"], optional["systemId"] = true, true
+		_, hasPublic := decl["publicId"]
+		_, hasSystem := decl["systemId"]
+		if !hasPublic && !hasSystem {
+			v.addf(path, "記法の宣言には publicId または systemId が必要です")
+		}
+	case DoctypeDeclComment:
+		required["text"] = true
+	case DoctypeDeclPI:
+		required["target"], optional["data"] = true, true
+	case DoctypeDeclPERef:
+		required["name"] = true
+	default:
+		v.addf(jsonPointer(path, "type"), "未知の宣言の種類です: %v", decl["type"])
+		return
+	}
+	v.validateDoctypeFields(path, decl, required, optional)
+
+	if decl["type"] == DoctypeDeclAttlist {
+		attributes, ok := decl["attributes"].([]interface{})
+		if !ok {
+			v.addf(jsonPointer(path, "attributes"), "attributes は配列である必要があります")
+			return
+		}
+		for i, item := range attributes {
+			attrPath := fmt.Sprintf("%s/%d", jsonPointer(path, "attributes"), i)
+			attr, ok := item.(map[string]interface{})
+			if !ok {
+				v.addf(attrPath, "属性の定義はオブジェクトである必要があります（%s）", jsonTypeName(item))
+				continue
+			}
+			v.validateDoctypeFields(attrPath, attr, map[string]bool{"name": true, "type": true}, map[string]bool{"default": true, "value": true})
+			switch attr["default"] {
+			case "#REQUIRED", "#IMPLIED":
+				if _, ok := attr["value"]; ok {
+					v.addf(attrPath, "%v の属性には value を指定できません", attr["default"])
+				}
+			case "#FIXED", nil:
+				if _, ok := attr["value"]; !ok {
+					v.addf(attrPath, "既定値の value が必要です")
+				}
+			default:
+				v.addf(jsonPointer(attrPath, "default"), "default は #REQUIRED, #IMPLIED, #FIXED のいずれかである必要があります")
+			}
+		}
+	}
+}
+
+// DOCTYPE のオブジェクトの項目を検証する。必須の項目がない場合と、未知の項目がある場合を報告する。
+// attributes, subset, parameter 以外の項目は文字列である必要がある。
+func (v *jsonValidator) validateDoctypeFields(path string, obj map[string]interface{}, required, optional map[string]bool) {
+	for key := range required {
+		if _, ok := obj[key]; !ok {
+			v.addf(path, "%s がありません", key)
+		}
+	}
+	for _, key := range sortedKeys(obj) {
+		if !required[key] && !optional[key] {
+			v.addf(jsonPointer(path, key), "未知の項目です")
+			continue
+		}
+		switch key {
+		case "attributes", "subset", "parameter":
+		default:
+			if _, ok := obj[key].(string); !ok {
+				v.addf(jsonPointer(path, key), "%s は文字列である必要があります（%s）", key, jsonTypeName(obj[key]))
+			}
+		}
+	}
+	if name, ok := obj["name"].(string); ok && obj["type"] != DoctypeDeclPERef && !isValidXMLName(name) {
+		v.addf(jsonPointer(path, "name"), "XMLの名前として使えない名前です: %q", name)
+	}
+}
+
+// $nodeOrder（トップレベルのノードの並び）を検証する。
+func (v *jsonValidator) validateNodeOrder(path string, value interface{}) {
+	order, ok := value.([]interface{})
+	if !ok {
+		v.addf(path, "%s は JSON Pointer の配列である必要があります（%s）", keys.NodeOrder(), jsonTypeName(value))
+		return
+	}
+	for i, item := range order {
+		if pointer, ok := item.(string); !ok || !strings.HasPrefix(pointer, "/") {
+			v.addf(fmt.Sprintf("%s/%d", path, i), "JSON Pointer（\"/\" で始まる文字列）である必要があります")
+		}
+	}
+}
+
+// メタデータの接頭辞で始まる未知のキーを報告する。
+func (v *jsonValidator) validateUnknownReservedKey(path string, key string) {
+	if strings.HasPrefix(key, keys.MetaPrefix) {
+		v.addf(path, "未知の予約キーです。要素名として使う場合は %q と書いてください", keys.EscapePrefix+key)
+	}
+}
+
+// xmlns 宣言を検証する。
+func (v *jsonValidator) validateXmlns(path string, value interface{}) {
+	switch ns := value.(type) {
+	case string:
+	case map[string]interface{}:
+		for _, prefix := range sortedKeys(ns) {
+			if _, ok := ns[prefix].(string); !ok {
+				v.addf(jsonPointer(path, prefix), "名前空間URIは文字列である必要があります（%s）", jsonTypeName(ns[prefix]))
+			}
+			if prefix != keys.Text && !isValidXMLName(prefix) {
+				v.addf(jsonPointer(path, prefix), "名前空間プレフィックスとして使えない名前です")
+			}
+		}
+	default:
+		v.addf(path, "名前空間宣言はオブジェクトまたは文字列である必要があります（%s）", jsonTypeName(value))
+	}
+}
+
+// $attrOrder を検証する。
+func (v *jsonValidator) validateAttrOrder(path string, value interface{}) {
+	arr, ok := value.([]interface{})
+	if !ok {
+		v.addf(path, "属性の並び順は文字列の配列である必要があります（%s）", jsonTypeName(value))
+		return
+	}
+	for i, item := range arr {
+		name, ok := item.(string)
+		if !ok {
+			v.addf(fmt.Sprintf("%s/%d", path, i), "属性名は文字列である必要があります（%s）", jsonTypeName(item))
+		} else if !keys.IsAttr(name) {
+			v.addf(fmt.Sprintf("%s/%d", path, i), "%q は属性名ではありません（%q で始まる必要があります）", name, keys.AttrPrefix)
+		}
+	}
+}
+
+// $orderMap を検証する。
+func (v *jsonValidator) validateOrderMap(path string, value interface{}) {
+	orderMap, ok := value.(map[string]interface{})
+	if !ok {
+		v.addf(path, "順序情報はオブジェクトである必要があります（%s）", jsonTypeName(value))
+		return
+	}
+	for _, key := range sortedKeys(orderMap) {
+		arr, ok := orderMap[key].([]interface{})
+		if !ok {
+			v.addf(jsonPointer(path, key), "要素名の配列である必要があります（%s）", jsonTypeName(orderMap[key]))
+			continue
+		}
+		for i, item := range arr {
+			if _, ok := item.(string); !ok {
+				v.addf(fmt.Sprintf("%s/%d", jsonPointer(path, key), i), "要素名は文字列である必要があります（%s）", jsonTypeName(item))
+			}
+		}
+	}
+}
+
+// $pi を検証する。
+func (v *jsonValidator) validatePIs(path string, value interface{}) {
+	arr, ok := value.([]interface{})
+	if !ok {
+		v.addf(path, "処理命令は配列である必要があります（%s）", jsonTypeName(value))
+		return
+	}
+	for i, item := range arr {
+		itemPath := fmt.Sprintf("%s/%d", path, i)
+		pi, ok := item.(map[string]interface{})
+		if !ok {
+			v.addf(itemPath, "処理命令はオブジェクトである必要があります（%s）", jsonTypeName(item))
+			continue
+		}
+		target, ok := pi["target"].(string)
+		if !ok {
+			v.addf(jsonPointer(itemPath, "target"), "処理命令のターゲットがありません")
+		} else if !isValidXMLName(target) {
+			v.addf(jsonPointer(itemPath, "target"), "処理命令のターゲットとして使えない名前です: %q", target)
+		}
+		if data, exists := pi["data"]; exists {
+			if s, ok := data.(string); !ok {
+				v.addf(jsonPointer(itemPath, "data"), "処理命令のデータは文字列である必要があります（%s）", jsonTypeName(data))
+			} else if strings.Contains(s, "?>") {
+				v.addf(jsonPointer(itemPath, "data"), "処理命令のデータに \"?>\" は含められません")
+			}
+		}
+		for _, key := range sortedKeys(pi) {
+			if key != "target" && key != "data" {
+				v.addf(jsonPointer(itemPath, key), "処理命令の未知のプロパティです")
+			}
+		}
+	}
+}
+
+// $comment を検証する。
+func (v *jsonValidator) validateComments(path string, value interface{}) {
+	arr, ok := value.([]interface{})
+	if !ok {
+		v.addf(path, "コメントは文字列の配列である必要があります（%s）", jsonTypeName(value))
+		return
+	}
+	for i, item := range arr {
+		itemPath := fmt.Sprintf("%s/%d", path, i)
+		comment, ok := item.(string)
+		if !ok {
+			v.addf(itemPath, "コメントは文字列である必要があります（%s）", jsonTypeName(item))
+		} else if strings.Contains(comment, "--") || strings.HasSuffix(comment, "-") {
+			v.addf(itemPath, "コメントに \"--\" を含めたり \"-\" で終えたりはできません")
+		}
+	}
+}
+
+// マップのキーを昇順で返す。
+func sortedKeys(m map[string]interface{}) []string {
+	result := make([]string, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}